@@ -0,0 +1,19 @@
+package fsmount
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// errNoAttr is the errno for a missing extended attribute.
+const errNoAttr = syscall.ENOATTR
+
+func statTimes(st *syscall.Stat_t) (atime, ctime time.Time) {
+	return time.Unix(st.Atimespec.Unix()), time.Unix(st.Ctimespec.Unix())
+}
+
+func setBlocks(out *fuse.Attr, blocks uint64) {
+	out.Blocks = blocks
+}
@@ -0,0 +1,21 @@
+package fsmount
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// errNoAttr is the errno for a missing extended attribute.
+const errNoAttr = syscall.ENODATA
+
+func statTimes(st *syscall.Stat_t) (atime, ctime time.Time) {
+	return time.Unix(st.Atim.Unix()), time.Unix(st.Ctim.Unix())
+}
+
+func setBlocks(out *fuse.Attr, blocks uint64) {
+	out.Blocks = blocks
+	// go-fuse estimates the blocks from the size if Blksize is zero.
+	out.Blksize = 4096
+}
@@ -309,7 +309,7 @@ func (*reversiFS) ReadDir(name string) ([]fs.DirEntry, error) {
 
 func main() {
 
-	mount, _ := fsmount.MountFS("O:", &reversiFS{}, nil)
+	mount, _ := fsmount.MountFS("O:", &reversiFS{}, &fsmount.MountOptions{UnmountOnInterrupt: true})
 	defer mount.Close()
 
 	// Block forever
@@ -7,7 +7,7 @@ import (
 )
 
 func main() {
-	mount, _ := fsmount.MountFS("X:", os.DirFS("."), nil)
+	mount, _ := fsmount.MountFS("X:", os.DirFS("."), &fsmount.MountOptions{UnmountOnInterrupt: true})
 	defer mount.Close()
 
 	// Block forever
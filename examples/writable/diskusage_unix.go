@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/binzume/fsmount"
+)
+
+func (fsys *writableDirFS) DiskUsage() (fsmount.DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(fsys.path, &st); err != nil {
+		return fsmount.DiskUsage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return fsmount.DiskUsage{
+		Total:     uint64(st.Blocks) * bsize,
+		Free:      uint64(st.Bfree) * bsize,
+		Available: uint64(st.Bavail) * bsize,
+		Files:     uint64(st.Files),
+		FreeFiles: uint64(st.Ffree),
+	}, nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+
+	"github.com/binzume/fsmount"
+)
+
+func (fsys *writableDirFS) DiskUsage() (fsmount.DiskUsage, error) {
+	dir, err := windows.UTF16PtrFromString(fsys.path)
+	if err != nil {
+		return fsmount.DiskUsage{}, err
+	}
+	var usage fsmount.DiskUsage
+	err = windows.GetDiskFreeSpaceEx(dir, &usage.Available, &usage.Total, &usage.Free)
+	return usage, err
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"io"
 	"io/fs"
 	"os"
+	"os/signal"
 	"path"
+	"time"
 
 	"github.com/binzume/fsmount"
 )
@@ -25,6 +28,17 @@ func (fsys *writableDirFS) OpenWriter(name string, flag int) (io.WriteCloser, er
 	return os.OpenFile(path.Join(fsys.path, name), flag, fs.ModePerm)
 }
 
+func (fsys *writableDirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.OpenFile(path.Join(fsys.path, name), flag, perm)
+}
+
+func (fsys *writableDirFS) SupportsAppend() bool {
+	return true
+}
+
 func (fsys *writableDirFS) Truncate(name string, size int64) error {
 	if !fs.ValidPath(name) {
 		return &fs.PathError{Op: "truncate", Path: name, Err: fs.ErrInvalid}
@@ -53,6 +67,55 @@ func (fsys *writableDirFS) Rename(name, newName string) error {
 	return os.Rename(path.Join(fsys.path, name), path.Join(fsys.path, newName))
 }
 
+func (fsys *writableDirFS) Chmod(name string, mode fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Chmod(path.Join(fsys.path, name), mode)
+}
+
+func (fsys *writableDirFS) Chown(name string, uid, gid int) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chown", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Lchown(path.Join(fsys.path, name), uid, gid)
+}
+
+func (fsys *writableDirFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Chtimes(path.Join(fsys.path, name), atime, mtime)
+}
+
+func (fsys *writableDirFS) Link(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) {
+		return &fs.PathError{Op: "link", Path: oldname, Err: fs.ErrInvalid}
+	}
+	return os.Link(path.Join(fsys.path, oldname), path.Join(fsys.path, newname))
+}
+
+func (fsys *writableDirFS) Readlink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Readlink(path.Join(fsys.path, name))
+}
+
+func (fsys *writableDirFS) Lstat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Lstat(path.Join(fsys.path, name))
+}
+
+func (fsys *writableDirFS) Symlink(oldname, newname string) error {
+	if !fs.ValidPath(newname) {
+		return &fs.PathError{Op: "symlink", Path: newname, Err: fs.ErrInvalid}
+	}
+	return os.Symlink(oldname, path.Join(fsys.path, newname))
+}
+
 func main() {
 	srcDir := "."
 	mountPoint := "X:"
@@ -64,12 +127,15 @@ func main() {
 		mountPoint = os.Args[2]
 	}
 
-	mount, err := fsmount.MountFS(mountPoint, NewWritableDirFS(srcDir), nil)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	mount, err := fsmount.MountFSContext(ctx, mountPoint, NewWritableDirFS(srcDir), nil)
 	if err != nil {
 		panic(err)
 	}
 	defer mount.Close()
 
-	// Block forever
-	select {}
+	// Block until interrupted
+	<-ctx.Done()
 }
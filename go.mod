@@ -5,6 +5,5 @@ go 1.17
 require (
 	github.com/binzume/dkango v0.1.5
 	github.com/hanwen/go-fuse/v2 v2.1.0
+	golang.org/x/sys v0.0.0-20220818161305-2296e01440c6
 )
-
-require golang.org/x/sys v0.0.0-20220818161305-2296e01440c6 // indirect
@@ -1,25 +1,244 @@
 package fsmount
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// ErrNoAttr is returned by XattrFS when the named attribute does not exist.
+var ErrNoAttr = errors.New("no such attribute")
+
+// ErrnoError can be returned by FS to specify the error number passed to the kernel explicitly. (FUSE only)
+// Otherwise, syscall.Errno in the error chain or well-known errors such as fs.ErrNotExist are mapped to errno,
+// and other errors are reported as EIO.
+type ErrnoError interface {
+	error
+	Errno() syscall.Errno
+}
+
 type MountOptions struct {
-	ReadOnly   bool // Windows only: Even if the file system supports writing file, treat as read-only.
-	Debug      bool // Print debug logs.
-	FuseOption interface{}
+	ReadOnly   bool        // Even if the file system supports writing file, treat as read-only.
+	Debug      bool        // Print debug logs.
+	FuseOption interface{} // *dkango.MountOptions on Windows, *fuse.MountOptions of go-fuse on others.
+	// Unmount and exit the process with status 1 on os.Interrupt.
+	UnmountOnInterrupt bool
+	// FUSE only: Stage writes in a temporary file if the writer doesn't support random access, and write it on close.
+	StageWrites bool
+
+	// FUSE only: How long the kernel caches attributes, entries and missing entries. nil means default. Zero disables caching.
+	AttrTimeout     *time.Duration
+	EntryTimeout    *time.Duration
+	NegativeTimeout *time.Duration
+	KeepPageCache   bool // FUSE only: Keep cached file data when the file is opened again.
+	DirectIO        bool // FUSE only: Bypass the page cache. Useful for files whose size is unknown or changes.
+
+	AllowOther  bool   // FUSE only: Allow access by other users. Non-root users need user_allow_other in /etc/fuse.conf.
+	FsName      string // FUSE only: Source name shown in mount(8) and df(1).
+	Subtype     string // Type of the file system. e.g. fuse.<Subtype> on Linux. File system name on Windows.
+	VolumeLabel string // Windows and macOS only: Volume label.
+	// FUSE only: Override the owner and permissions of all files.
+	UID   *uint32
+	GID   *uint32
+	Umask fs.FileMode // Permission bits to clear.
 }
 
+// MountHandle is a handle of the mounted file system.
+// Names are slash-separated paths in the fs.FS. Invalidate* methods tell the kernel that the file was changed outside the mount.
 type MountHandle interface {
 	io.Closer
+	// InvalidatePath discards cached attributes and data of the named file.
+	InvalidatePath(name string) error
+	// InvalidateData discards cached data of the named file in the range. Negative length means to the end of file.
+	InvalidateData(name string, off, length int64) error
+	// InvalidateEntry discards the cached lookup of name in dir. Use after a file is created or removed.
+	InvalidateEntry(dir, name string) error
+
+	// Done returns a channel which is closed when the file system is unmounted.
+	Done() <-chan struct{}
+	// Wait blocks until the file system is unmounted, and returns the reason.
+	// It returns nil if unmounted by Close(), the error of the context for MountFSContext, or ErrUnmounted.
+	Wait() error
+	MountPoint() string
+	Stats() MountStats
+}
+
+// ErrUnmounted is returned by MountHandle.Wait when the file system is unmounted externally. e.g. fusermount -u
+var ErrUnmounted = errors.New("unmounted externally")
+
+type MountStats struct {
+	OpenFiles int // Number of open file handles.
+}
+
+// mountState tracks the lifecycle of a mount.
+type mountState struct {
+	mountPoint string
+	unmountFn  func() error
+	stopWatch  context.CancelFunc
+	done       chan struct{}
+
+	mu        sync.Mutex
+	unmounted bool
+	err       error // Reason of unmount.
+}
+
+func newMountState(mountPoint string, unmount func() error) *mountState {
+	return &mountState{mountPoint: mountPoint, unmountFn: unmount, done: make(chan struct{})}
+}
+
+func (s *mountState) Close() error {
+	return s.unmount(nil)
+}
+
+func (s *mountState) unmount(reason error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unmounted {
+		return nil
+	}
+	err := s.unmountFn()
+	if err != nil {
+		return err
+	}
+	s.finish(reason)
+	return nil
+}
+
+// stopped is called when the server stops serving. It's no-op if unmounted by unmount().
+func (s *mountState) stopped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish(ErrUnmounted)
+}
+
+// finish marks the file system as unmounted. s.mu must be held.
+func (s *mountState) finish(reason error) {
+	if s.unmounted {
+		return
+	}
+	s.unmounted = true
+	s.err = reason
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	close(s.done)
+}
+
+// watch subscribes to changes of fsys until the file system is unmounted.
+func (s *mountState) watch(fsys fs.FS, h MountHandle) error {
+	stop, err := watchChanges(fsys, h)
+	if err != nil || stop == nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unmounted {
+		stop()
+	} else {
+		s.stopWatch = stop
+	}
+	return nil
+}
+
+func (s *mountState) Done() <-chan struct{} {
+	return s.done
 }
 
+func (s *mountState) Wait() error {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *mountState) MountPoint() string {
+	return s.mountPoint
+}
+
+// MountFS mounts fsys on mountPoint.
+func MountFS(mountPoint string, fsys fs.FS, opt *MountOptions) (MountHandle, error) {
+	return MountFSContext(context.Background(), mountPoint, fsys, opt)
+}
+
+// MountFSContext mounts fsys on mountPoint, and unmounts it when ctx is done.
+func MountFSContext(ctx context.Context, mountPoint string, fsys fs.FS, opt *MountOptions) (MountHandle, error) {
+	if opt == nil {
+		opt = &MountOptions{}
+	}
+	h, err := mount(mountPoint, fsys, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	var interrupt chan os.Signal
+	if opt.UnmountOnInterrupt {
+		interrupt = make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+	}
+	if interrupt == nil && ctx.Done() == nil {
+		return h, nil
+	}
+	go func() {
+		if interrupt != nil {
+			defer signal.Stop(interrupt)
+		}
+		select {
+		case <-ctx.Done():
+			// Retry until the file system is no longer busy.
+			delay := 100 * time.Millisecond
+			for h.unmount(ctx.Err()) != nil {
+				select {
+				case <-h.done:
+					return
+				case <-time.After(delay):
+				}
+				if delay < 5*time.Second {
+					delay *= 2
+				}
+			}
+		case <-interrupt:
+			err := h.Close()
+			if err != nil {
+				fmt.Printf("Failed to unmount %s, you should umount manually: %v\n", mountPoint, err)
+			}
+			os.Exit(1)
+		case <-h.done:
+		}
+	}()
+	return h, nil
+}
+
+// OpenWriterFS opens a file for writing.
+// Returned file is closed when the last file descriptor is closed, and the error of Close() is lost on FUSE.
+// If the file implements Flush() error, it is called on each close(2) and its error is reported.
 type OpenWriterFS interface {
 	fs.FS
 	OpenWriter(name string, flag int) (io.WriteCloser, error)
 }
 
+// OpenFileFS opens a file with flags such as os.O_RDWR.
+// Returned file may implement io.ReaderAt, io.WriterAt, Truncate(int64), Sync() and Stat().
+// On FUSE, OpenFileFS is preferred over OpenWriterFS.
+type OpenFileFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
+// AppendFS declares that files opened by OpenFile or OpenWriter with os.O_APPEND always write at the end of file.
+// Otherwise, O_APPEND is emulated by writing at the current size of the file. (FUSE only)
+type AppendFS interface {
+	fs.FS
+	SupportsAppend() bool
+}
+
 type RemoveFS interface {
 	fs.FS
 	Remove(name string) error
@@ -44,3 +263,230 @@ type TruncateFS interface {
 	fs.FS
 	Truncate(name string, size int64) error
 }
+
+type ReadlinkFS interface {
+	fs.FS
+	Readlink(name string) (string, error)
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+type SymlinkFS interface {
+	fs.FS
+	Symlink(oldname, newname string) error
+}
+
+type LinkFS interface {
+	fs.FS
+	Link(oldname, newname string) error
+}
+
+type ChmodFS interface {
+	fs.FS
+	Chmod(name string, mode fs.FileMode) error
+}
+
+type ChownFS interface {
+	fs.FS
+	Chown(name string, uid, gid int) error
+}
+
+// ChtimesFS changes the access and modification times of the named file.
+// On FUSE, a time left unchanged by the caller is passed as the current time of the file, so both times are always set.
+type ChtimesFS interface {
+	fs.FS
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+// XattrFS provides extended attributes.
+// flags of SetXattr are XATTR_CREATE or XATTR_REPLACE as in setxattr(2).
+type XattrFS interface {
+	fs.FS
+	GetXattr(name string, attr string) ([]byte, error)
+	SetXattr(name string, attr string, data []byte, flags int) error
+	ListXattr(name string) ([]string, error)
+	RemoveXattr(name string, attr string) error
+}
+
+// Attr can be returned by FileInfo.Sys() to provide attributes which fs.FileInfo doesn't have. (FUSE only)
+// Zero fields are ignored, and ModTime() is used for zero ATime and CTime.
+// *syscall.Stat_t returned by os.Stat() is also supported.
+type Attr struct {
+	Dev    uint64 // Device ID. Inodes are shared only on the same device as the root.
+	Ino    uint64 // Inode number. Files with the same Dev and Ino share the inode. e.g. hard links
+	Nlink  uint32
+	UID    uint32
+	GID    uint32
+	Blocks uint64 // Number of 512-byte blocks. Estimated from the size if zero.
+	ATime  time.Time
+	CTime  time.Time
+}
+
+// DiskUsage represents the capacity of a filesystem.
+type DiskUsage struct {
+	Total     uint64 // Total size in bytes
+	Free      uint64 // Free size in bytes
+	Available uint64 // Free size in bytes available to unprivileged users
+	Files     uint64 // Total number of file nodes
+	FreeFiles uint64 // Free number of file nodes
+}
+
+type DiskUsageFS interface {
+	fs.FS
+	DiskUsage() (DiskUsage, error)
+}
+
+type ChangeKind int
+
+const (
+	ChangeModify ChangeKind = iota // Content or attributes of the file are changed.
+	ChangeCreate                   // The file is created.
+	ChangeRemove                   // The file is removed. Renaming is reported as ChangeRemove and ChangeCreate.
+)
+
+type ChangeEvent struct {
+	Name string // Slash-separated path of the changed file.
+	Kind ChangeKind
+}
+
+// WatchFS reports changes made outside the mount. MountFS subscribes to it and invalidates the kernel cache.
+// The channel should be closed when ctx is done, which happens when the file system is unmounted.
+type WatchFS interface {
+	fs.FS
+	Watch(ctx context.Context) (<-chan ChangeEvent, error)
+}
+
+// watchChanges subscribes to changes of fsys and invalidates the cache of h.
+// Returns nil if fsys doesn't implement WatchFS.
+func watchChanges(fsys fs.FS, h MountHandle) (context.CancelFunc, error) {
+	wfs, ok := fsys.(WatchFS)
+	if !ok {
+		return nil, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := wfs.Watch(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		for ev := range events {
+			switch ev.Kind {
+			case ChangeModify:
+				h.InvalidatePath(ev.Name)
+			case ChangeCreate, ChangeRemove:
+				dir := path.Dir(ev.Name)
+				h.InvalidateEntry(dir, path.Base(ev.Name))
+				h.InvalidatePath(dir)
+			}
+		}
+	}()
+	return cancel, nil
+}
+
+// Caller identifies the process which issued the request.
+type Caller struct {
+	UID uint32
+	GID uint32
+	PID uint32
+}
+
+// CallerFromContext returns the caller of the request from the context passed to *ContextFS. (FUSE only)
+func CallerFromContext(ctx context.Context) (Caller, bool) {
+	return callerFromContext(ctx)
+}
+
+// Context-aware variants of the interfaces. If implemented, they are preferred and
+// called with a context of the request. (FUSE only)
+// The context is canceled when the request is interrupted or the file system is being unmounted,
+// and context.Canceled in the returned error is reported as EINTR.
+// The context is valid only during the call, so opened files must not depend on it.
+
+// StatContextFS is preferred over Lstat of ReadlinkFS, so StatContext shouldn't follow symlinks in that case.
+type StatContextFS interface {
+	fs.FS
+	StatContext(ctx context.Context, name string) (fs.FileInfo, error)
+}
+
+type OpenContextFS interface {
+	fs.FS
+	OpenContext(ctx context.Context, name string) (fs.File, error)
+}
+
+type OpenWriterContextFS interface {
+	fs.FS
+	OpenWriterContext(ctx context.Context, name string, flag int) (io.WriteCloser, error)
+}
+
+type OpenFileContextFS interface {
+	fs.FS
+	OpenFileContext(ctx context.Context, name string, flag int, perm fs.FileMode) (fs.File, error)
+}
+
+type RemoveContextFS interface {
+	fs.FS
+	RemoveContext(ctx context.Context, name string) error
+}
+
+type RenameContextFS interface {
+	fs.FS
+	RenameContext(ctx context.Context, name string, newName string) error
+}
+
+type MkdirContextFS interface {
+	fs.FS
+	MkdirContext(ctx context.Context, name string, mode fs.FileMode) error
+}
+
+type TruncateContextFS interface {
+	fs.FS
+	TruncateContext(ctx context.Context, name string, size int64) error
+}
+
+type ChmodContextFS interface {
+	fs.FS
+	ChmodContext(ctx context.Context, name string, mode fs.FileMode) error
+}
+
+type ChownContextFS interface {
+	fs.FS
+	ChownContext(ctx context.Context, name string, uid, gid int) error
+}
+
+type ChtimesContextFS interface {
+	fs.FS
+	ChtimesContext(ctx context.Context, name string, atime time.Time, mtime time.Time) error
+}
+
+type OpenDirContextFS interface {
+	fs.FS
+	OpenDirContext(ctx context.Context, name string) (fs.ReadDirFile, error)
+}
+
+type ReadlinkContextFS interface {
+	fs.FS
+	ReadlinkContext(ctx context.Context, name string) (string, error)
+	LstatContext(ctx context.Context, name string) (fs.FileInfo, error)
+}
+
+type SymlinkContextFS interface {
+	fs.FS
+	SymlinkContext(ctx context.Context, oldname, newname string) error
+}
+
+type LinkContextFS interface {
+	fs.FS
+	LinkContext(ctx context.Context, oldname, newname string) error
+}
+
+type XattrContextFS interface {
+	fs.FS
+	GetXattrContext(ctx context.Context, name string, attr string) ([]byte, error)
+	SetXattrContext(ctx context.Context, name string, attr string, data []byte, flags int) error
+	ListXattrContext(ctx context.Context, name string) ([]string, error)
+	RemoveXattrContext(ctx context.Context, name string, attr string) error
+}
+
+// ReaderAtContext can be implemented by opened files to make reads cancelable. It's preferred over io.ReaderAt. (FUSE only)
+type ReaderAtContext interface {
+	ReadAtContext(ctx context.Context, b []byte, off int64) (int, error)
+}
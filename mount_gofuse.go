@@ -4,19 +4,26 @@
 package fsmount
 
 import (
+	"context"
 	"errors"
 	"io"
 	"io/fs"
-
-	"fmt"
 	"os"
-	"os/signal"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
-	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
-	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
 )
 
+// Number of entries fetched from fs.ReadDirFile at once.
+const readDirBatchSize = 256
+
 func readAt(f io.Closer, b []byte, off int64) (int, error) {
 	if f, ok := f.(io.ReaderAt); ok {
 		return f.ReadAt(b, off)
@@ -45,19 +52,123 @@ func writeAt(f io.Closer, b []byte, off int64) (int, error) {
 	return 0, fs.ErrInvalid
 }
 
-func errToStatus(err error) fuse.Status {
+func errToErrno(err error) syscall.Errno {
+	var errnoErr ErrnoError
+	var errno syscall.Errno
 	if err == nil {
-		return fuse.OK
+		return fusefs.OK
+	} else if errors.As(err, &errnoErr) {
+		return errnoErr.Errno()
+	} else if errors.As(err, &errno) {
+		return errno
 	} else if err == io.EOF {
-		return fuse.ENODATA
+		return syscall.ENODATA
 	} else if errors.Is(err, io.ErrUnexpectedEOF) {
-		return fuse.ENODATA
+		return syscall.ENODATA
+	} else if errors.Is(err, ErrNoAttr) {
+		return errNoAttr
+	} else if errors.Is(err, context.Canceled) {
+		return syscall.EINTR
 	} else if errors.Is(err, fs.ErrNotExist) {
-		return fuse.ENOENT
+		return syscall.ENOENT
 	} else if errors.Is(err, fs.ErrPermission) {
-		return fuse.EPERM
+		return syscall.EPERM
+	} else if errors.Is(err, fs.ErrExist) {
+		return syscall.EEXIST
+	} else if errors.Is(err, fs.ErrInvalid) {
+		return syscall.EINVAL
+	} else if errors.Is(err, fs.ErrClosed) {
+		return syscall.EBADF
+	}
+	return syscall.EIO
+}
+
+func fileType(m fs.FileMode) uint32 {
+	switch {
+	case m&fs.ModeDir != 0:
+		return fuse.S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		return fuse.S_IFLNK
+	case m&fs.ModeNamedPipe != 0:
+		return fuse.S_IFIFO
+	case m&fs.ModeSocket != 0:
+		return syscall.S_IFSOCK
+	case m&fs.ModeCharDevice != 0:
+		return syscall.S_IFCHR
+	case m&fs.ModeDevice != 0:
+		return syscall.S_IFBLK
+	}
+	return fuse.S_IFREG
+}
+
+// fileAttr returns the attributes provided by fi.Sys(), or nil.
+func fileAttr(fi fs.FileInfo) *Attr {
+	switch sys := fi.Sys().(type) {
+	case *Attr:
+		return sys
+	case Attr:
+		return &sys
+	case *syscall.Stat_t:
+		atime, ctime := statTimes(sys)
+		return &Attr{
+			Dev:    uint64(sys.Dev),
+			Ino:    uint64(sys.Ino),
+			Nlink:  uint32(sys.Nlink),
+			UID:    sys.Uid,
+			GID:    sys.Gid,
+			Blocks: uint64(sys.Blocks),
+			ATime:  atime,
+			CTime:  ctime,
+		}
 	}
-	return fuse.ENOSYS
+	return nil
+}
+
+func fillAttr(fi fs.FileInfo, out *fuse.Attr) {
+	mtime := fi.ModTime()
+	atime, ctime := mtime, mtime
+	out.Mode = uint32(fi.Mode().Perm()) | fileType(fi.Mode())
+	out.Size = uint64(fi.Size())
+	out.Nlink = 1
+	if attr := fileAttr(fi); attr != nil {
+		out.Uid = attr.UID
+		out.Gid = attr.GID
+		if attr.Nlink != 0 {
+			out.Nlink = attr.Nlink
+		}
+		if attr.Blocks != 0 {
+			setBlocks(out, attr.Blocks)
+		}
+		if !attr.ATime.IsZero() {
+			atime = attr.ATime
+		}
+		if !attr.CTime.IsZero() {
+			ctime = attr.CTime
+		}
+	}
+	out.SetTimes(&atime, &mtime, &ctime)
+}
+
+func stableAttr(attr *fuse.Attr) fusefs.StableAttr {
+	id := fusefs.StableAttr{Mode: attr.Mode & syscall.S_IFMT, Ino: attr.Ino}
+	if id.Reserved() {
+		id.Ino = 0
+	}
+	return id
+}
+
+func unixMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode).Perm()
+	if mode&syscall.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
 }
 
 func fixPath(name string) string {
@@ -67,243 +178,1229 @@ func fixPath(name string) string {
 	return name
 }
 
+// canceler cancels contexts of in-flight requests.
+type canceler struct {
+	mu       sync.Mutex
+	canceled chan struct{} // Closed by cancelAll().
+}
+
+// withCancel returns a context of the request which is also canceled by cancelAll().
+func (c *canceler) withCancel(ctx context.Context) (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	if c.canceled == nil {
+		c.canceled = make(chan struct{})
+	}
+	canceled := c.canceled
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-canceled:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// cancelAll cancels the requests in flight. Requests started later are not affected.
+func (c *canceler) cancelAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.canceled != nil {
+		close(c.canceled)
+		c.canceled = nil
+	}
+}
+
 type fuseFs struct {
-	pathfs.FileSystem
-	fsys fs.FS
+	openFiles   int64 // Number of open files. Accessed atomically.
+	canceler    canceler
+	fsys        fs.FS
+	readOnly    bool
+	uid, gid    *uint32 // Owner of all files if not nil.
+	umask       fs.FileMode
+	stageWrites bool
+	dev         uint64 // Device of the root. Inode numbers are unique only within a device.
+	openFlags   uint32 // FOPEN_* flags returned by Open.
+}
+
+// fillAttr fills out with fi and the overrides of the mount.
+func (fsys *fuseFs) fillAttr(fi fs.FileInfo, out *fuse.Attr) {
+	fillAttr(fi, out)
+	out.Ino = fsys.fileIno(fi)
+	fsys.overrideAttr(out)
+}
+
+// fileIno returns the inode number of fi to share the inode, or 0 to let go-fuse assign a new one.
+// go-fuse identifies inodes without the device, so files on other devices than the root are not shared.
+func (fsys *fuseFs) fileIno(fi fs.FileInfo) uint64 {
+	if attr := fileAttr(fi); attr != nil && attr.Dev == fsys.dev {
+		return attr.Ino
+	}
+	return 0
+}
+
+func (fsys *fuseFs) overrideAttr(out *fuse.Attr) {
+	if fsys.uid != nil {
+		out.Uid = *fsys.uid
+	}
+	if fsys.gid != nil {
+		out.Gid = *fsys.gid
+	}
+	out.Mode &^= uint32(fsys.umask.Perm())
 }
 
-func (t *fuseFs) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
-	name = fixPath(name)
-	f, err := fs.Stat(t.fsys, name)
+type fuseNode struct {
+	fusefs.Inode
+	*fuseFs
+
+	mu       sync.Mutex
+	staged   *stagedFile // Last staged file opened for this node.
+	appendMu sync.Mutex  // Serializes emulated O_APPEND writes to this node.
+}
+
+// inodePath returns the path of the inode, or ESTALE if it has been unlinked.
+// Path() of an unlinked inode is "" as well as the root.
+func inodePath(node *fusefs.Inode) (string, syscall.Errno) {
+	for p := node; !p.IsRoot(); {
+		if _, p = p.Parent(); p == nil {
+			return "", syscall.ESTALE
+		}
+	}
+	return fixPath(node.Path(nil)), fusefs.OK
+}
+
+func (n *fuseNode) path() (string, syscall.Errno) {
+	return inodePath(n.EmbeddedInode())
+}
+
+func (n *fuseNode) childPath(name string) (string, syscall.Errno) {
+	dir, errno := n.path()
+	return path.Join(dir, name), errno
+}
+
+func (n *fuseNode) stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	if fsys, ok := n.fsys.(ReadlinkContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return fsys.LstatContext(ctx, name)
+	}
+	if fsys, ok := n.fsys.(StatContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return fsys.StatContext(ctx, name)
+	}
+	if fsys, ok := n.fsys.(ReadlinkFS); ok {
+		return fsys.Lstat(name)
+	}
+	return fs.Stat(n.fsys, name)
+}
+
+// lookupChild looks up the named child and returns an inode for it.
+func (n *fuseNode) lookupChild(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	p, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+	fi, err := n.stat(ctx, p)
 	if err != nil {
-		return nil, errToStatus(err)
+		return nil, errToErrno(err)
 	}
+	n.fillAttr(fi, &out.Attr)
+	return n.newChild(ctx, name, out), fusefs.OK
+}
 
-	mode := uint32(f.Mode().Perm())
-	if f.IsDir() {
-		mode |= fuse.S_IFDIR
-	} else {
-		mode |= fuse.S_IFREG
+// newChild returns an inode for the named child with the attributes in out.
+// Inodes are shared by inode numbers from FileInfo.Sys() if available, so hard links refer to the same inode.
+// See fuseFs.fileIno. Otherwise, the current inode of the name is kept to keep its inode number stable.
+func (n *fuseNode) newChild(ctx context.Context, name string, out *fuse.EntryOut) *fusefs.Inode {
+	id := stableAttr(&out.Attr)
+	if id.Ino == 0 {
+		if child := n.GetChild(name); child != nil && child.StableAttr().Mode == id.Mode {
+			return child
+		}
 	}
-	return &fuse.Attr{
-		Mode:  mode,
-		Size:  uint64(f.Size()),
-		Ctime: uint64(f.ModTime().Unix()),
-		Mtime: uint64(f.ModTime().Unix()),
-		Atime: uint64(f.ModTime().Unix()),
-	}, fuse.OK
+	return n.NewInode(ctx, &fuseNode{fuseFs: n.fuseFs}, id)
 }
 
-func (t *fuseFs) OpenDir(name string, context *fuse.Context) (c []fuse.DirEntry, code fuse.Status) {
-	name = fixPath(name)
-	files, err := fs.ReadDir(t.fsys, name)
+func (n *fuseNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	return n.lookupChild(ctx, name, out)
+}
+
+func (n *fuseNode) Getattr(ctx context.Context, fh fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f, ok := fh.(*fuseFile); ok {
+		if st, ok := f.getFile().(interface{ Stat() (fs.FileInfo, error) }); ok {
+			if fi, err := st.Stat(); err == nil {
+				n.fillAttr(fi, &out.Attr)
+				return fusefs.OK
+			}
+		}
+	}
+	n.mu.Lock()
+	staged := n.staged
+	n.mu.Unlock()
+	if staged != nil {
+		// The file is being written. Stat() fails after the file is closed.
+		if fi, err := staged.Stat(); err == nil {
+			n.fillAttr(fi, &out.Attr)
+			return fusefs.OK
+		}
+	}
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return errno
+	}
+	fi, err := n.stat(ctx, name)
 	if err != nil {
-		return nil, errToStatus(err)
+		return errToErrno(err)
+	}
+	n.fillAttr(fi, &out.Attr)
+	return fusefs.OK
+}
+
+func (n *fuseNode) Setattr(ctx context.Context, fh fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return errno
+	}
+	f, _ := fh.(*fuseFile)
+
+	if mode, ok := in.GetMode(); ok {
+		if errno := n.chmod(ctx, name, mode); errno != fusefs.OK {
+			return errno
+		}
+	}
+
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		if errno := n.chown(ctx, name, uid, gid); errno != fusefs.OK {
+			return errno
+		}
 	}
 
-	result := []fuse.DirEntry{}
-	for _, f := range files {
-		result = append(result, fuse.DirEntry{Name: f.Name(), Mode: fuse.S_IFREG})
+	if size, ok := in.GetSize(); ok {
+		errno := syscall.ENOSYS
+		if f != nil {
+			errno = f.Truncate(size)
+		}
+		if errno == syscall.ENOSYS {
+			errno = n.truncate(ctx, name, size)
+		}
+		if errno != fusefs.OK {
+			return errno
+		}
+	}
+
+	atime, aok := in.GetATime()
+	mtime, mok := in.GetMTime()
+	if aok || mok {
+		var a, m *time.Time
+		if aok {
+			a = &atime
+		}
+		if mok {
+			m = &mtime
+		}
+		errno := syscall.ENOSYS
+		if f != nil {
+			errno = f.Utimens(a, m)
+		}
+		if errno == syscall.ENOSYS {
+			errno = n.utimens(ctx, name, a, m)
+		}
+		if errno != fusefs.OK {
+			return errno
+		}
 	}
 
-	return result, fuse.OK
+	return n.Getattr(ctx, fh, out)
 }
 
-func (t *fuseFs) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
-	name = fixPath(name)
+func (n *fuseNode) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return nil, errno
+	}
 
-	var f io.Closer
-	var err error
-	if flags&fuse.O_ANYWRITE != 0 {
-		if fsys, ok := t.fsys.(interface {
-			OpenWriter(string, int) (io.WriteCloser, error)
-		}); ok {
-			if int(flags)&os.O_APPEND != 0 {
-				// Cannot use O_APPEND because write offset is from start of file.
-				flags = (flags ^ uint32(os.O_APPEND)) | uint32(os.O_WRONLY)
+	var dir fs.ReadDirFile
+	_, openContext := n.fsys.(OpenContextFS)
+	if fsys, ok := n.fsys.(OpenDirContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		d, err := fsys.OpenDirContext(ctx, name)
+		cancel()
+		if err != nil {
+			return nil, errToErrno(err)
+		}
+		dir = d
+	} else if fsys, ok := n.fsys.(OpenDirFS); ok && !openContext {
+		d, err := fsys.OpenDir(name)
+		if err != nil {
+			return nil, errToErrno(err)
+		}
+		dir = d
+	} else {
+		f, err := n.open(ctx, name)
+		if err != nil {
+			return nil, errToErrno(err)
+		}
+		if d, ok := f.(fs.ReadDirFile); ok {
+			dir = d
+		} else {
+			f.Close()
+			// Fallback to fs.ReadDirFS. fs.ReadDir() would open the file again without the context.
+			fsys, ok := n.fsys.(fs.ReadDirFS)
+			if !ok {
+				return nil, syscall.ENOTDIR
+			}
+			files, err := fsys.ReadDir(name)
+			if err != nil {
+				return nil, errToErrno(err)
 			}
-			f, err = fsys.OpenWriter(name, int(flags))
+			return &dirStream{fsys: n.fuseFs, entries: files, err: io.EOF, dots: 2}, fusefs.OK
+		}
+	}
+	return &dirStream{fsys: n.fuseFs, dir: dir, dots: 2}, fusefs.OK
+}
+
+func (n *fuseNode) open(ctx context.Context, name string) (fs.File, error) {
+	if fsys, ok := n.fsys.(OpenContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return fsys.OpenContext(ctx, name)
+	}
+	return n.fsys.Open(name)
+}
+
+// openFile opens the named file by OpenFileFS, OpenWriterFS or Open.
+func (n *fuseNode) openFile(ctx context.Context, name string, flag int, perm fs.FileMode) (io.Closer, error) {
+	readOnly := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0
+	if fsys, ok := n.fsys.(OpenFileContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return fsys.OpenFileContext(ctx, name, flag, perm)
+	}
+	if _, ok := n.fsys.(OpenContextFS); ok && readOnly {
+		return n.open(ctx, name)
+	}
+	if fsys, ok := n.fsys.(OpenFileFS); ok {
+		return fsys.OpenFile(name, flag, perm)
+	}
+	if readOnly {
+		return n.open(ctx, name)
+	}
+	if fsys, ok := n.fsys.(OpenWriterContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return fsys.OpenWriterContext(ctx, name, flag)
+	}
+	if fsys, ok := n.fsys.(OpenWriterFS); ok {
+		return fsys.OpenWriter(name, flag)
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+}
+
+// newFile opens the named file for FUSE file handle.
+func (n *fuseNode) newFile(ctx context.Context, name string, flags uint32, perm fs.FileMode) (*fuseFile, error) {
+	file := &fuseFile{fsys: n.fsys, path: name, openFiles: &n.openFiles, canceler: &n.canceler}
+	if int(flags)&os.O_APPEND != 0 {
+		if fsys, ok := n.fsys.(AppendFS); ok && fsys.SupportsAppend() {
+			file.nativeAppend = true
 		} else {
-			return nil, fuse.EPERM
+			file.appendMu = &n.appendMu
+			// Write offset is from start of file. Emulate O_APPEND in fuseFile.Write().
+			flags = flags ^ uint32(os.O_APPEND)
+			if flags&fuse.O_ANYWRITE == 0 {
+				flags |= uint32(os.O_WRONLY)
+			}
 		}
-	} else {
-		f, err = t.fsys.Open(name)
 	}
+	f, err := n.openFile(ctx, name, int(flags), perm)
+	if err != nil {
+		return nil, err
+	}
+	file.file = f
+	if flags&fuse.O_ANYWRITE != 0 && n.stageWrites && !file.nativeAppend {
+		_, writerAt := f.(io.WriterAt)
+		_, seeker := f.(io.Seeker)
+		if w, ok := f.(io.WriteCloser); ok && !writerAt && !seeker {
+			reopen := func() (io.WriteCloser, error) {
+				f, err := n.openFile(context.Background(), name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+				if err != nil {
+					return nil, err
+				}
+				if w, ok := f.(io.WriteCloser); ok {
+					return w, nil
+				}
+				f.Close()
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+			}
+			staged, err := newStagedFile(n.fsys, name, w, flags&uint32(os.O_TRUNC) != 0, reopen)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			file.file = staged
+		}
+	} else if flags&fuse.O_ANYWRITE == 0 {
+		_, readerAt := f.(io.ReaderAt)
+		_, readerAtContext := f.(ReaderAtContext)
+		_, seeker := f.(io.Seeker)
+		if r, ok := f.(io.ReadCloser); ok && !readerAt && !readerAtContext && !seeker {
+			// Stream-only file. Keep read data to serve out-of-order reads.
+			file.file = newSpillReader(r, spillMemLimit)
+		}
+	}
+	atomic.AddInt64(&n.openFiles, 1)
+	return file, nil
+}
+
+func (n *fuseNode) Open(ctx context.Context, flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	if n.readOnly {
+		if flags&(fuse.O_ANYWRITE|uint32(os.O_TRUNC)) != 0 {
+			return nil, 0, syscall.EROFS
+		}
+		flags &^= uint32(os.O_APPEND)
+	}
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return nil, 0, errno
+	}
+	f, err := n.newFile(ctx, name, flags, 0)
 	if err != nil {
-		return nil, errToStatus(err)
+		return nil, 0, errToErrno(err)
 	}
-	return &fuseFile{File: nodefs.NewDefaultFile(), fsys: t.fsys, path: name, file: f}, fuse.OK
+	n.setStaged(f)
+	return f, n.openFlags, fusefs.OK
 }
 
-func (t *fuseFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
-	name = fixPath(name)
+func (n *fuseNode) setStaged(f *fuseFile) {
+	if staged, ok := f.file.(*stagedFile); ok {
+		n.mu.Lock()
+		n.staged = staged
+		n.mu.Unlock()
+	}
+}
 
-	fsys, ok := t.fsys.(interface {
-		OpenWriter(string, int) (io.WriteCloser, error)
-	})
+func (n *fuseNode) Release(ctx context.Context, fh fusefs.FileHandle) syscall.Errno {
+	f, ok := fh.(*fuseFile)
 	if !ok {
-		return nil, fuse.EPERM
+		return syscall.EBADF
+	}
+	if staged, ok := f.getFile().(*stagedFile); ok {
+		n.mu.Lock()
+		if n.staged == staged {
+			n.staged = nil
+		}
+		n.mu.Unlock()
 	}
+	return f.Release(ctx)
+}
 
-	f, err := fsys.OpenWriter(name, int(flags)|os.O_CREATE|os.O_TRUNC)
+func (n *fuseNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	if n.readOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+	name, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return nil, nil, 0, errno
+	}
+	f, err := n.newFile(ctx, name, flags|uint32(os.O_CREATE|os.O_TRUNC), unixMode(mode))
 	if err != nil {
-		return nil, errToStatus(err)
+		return nil, nil, 0, errToErrno(err)
 	}
 
-	return &fuseFile{File: nodefs.NewDefaultFile(), file: f, fsys: t.fsys, path: name}, fuse.OK
+	fi, err := n.stat(ctx, name)
+	if err == nil {
+		n.fillAttr(fi, &out.Attr)
+	} else {
+		// Some writers create the file on Close().
+		out.Attr.Mode = fuse.S_IFREG | mode&07777
+		n.overrideAttr(&out.Attr)
+	}
+	child := n.NewInode(ctx, &fuseNode{fuseFs: n.fuseFs}, stableAttr(&out.Attr))
+	child.Operations().(*fuseNode).setStaged(f)
+	return child, f, n.openFlags, fusefs.OK
 }
 
-func (f *fuseFs) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
-	if trunc, ok := f.fsys.(TruncateFS); ok {
-		return errToStatus(trunc.Truncate(name, int64(size)))
+func (n *fuseNode) truncate(ctx context.Context, name string, size uint64) syscall.Errno {
+	if trunc, ok := n.fsys.(TruncateContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(trunc.TruncateContext(ctx, name, int64(size)))
 	}
-	if fsys, ok := f.fsys.(interface {
-		OpenWriter(string, int) (io.WriteCloser, error)
-	}); ok {
-		f, err := fsys.OpenWriter(name, os.O_RDWR)
+	if trunc, ok := n.fsys.(TruncateFS); ok {
+		return errToErrno(trunc.Truncate(name, int64(size)))
+	}
+	_, ok1 := n.fsys.(OpenFileFS)
+	_, ok2 := n.fsys.(OpenWriterFS)
+	_, ok3 := n.fsys.(OpenFileContextFS)
+	_, ok4 := n.fsys.(OpenWriterContextFS)
+	if ok1 || ok2 || ok3 || ok4 {
+		f, err := n.openFile(ctx, name, os.O_RDWR, 0)
 		if err != nil {
-			return errToStatus(err)
+			return errToErrno(err)
 		}
+		defer f.Close()
 		if trunc, ok := f.(interface{ Truncate(int64) error }); ok {
-			return errToStatus(trunc.Truncate(int64(size)))
+			return errToErrno(trunc.Truncate(int64(size)))
 		}
-		defer f.Close()
 	}
+	return syscall.ENOSYS
+}
+
+func (n *fuseNode) chmod(ctx context.Context, name string, mode uint32) syscall.Errno {
+	if fsys, ok := n.fsys.(ChmodContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(fsys.ChmodContext(ctx, name, unixMode(mode)))
+	}
+	if fsys, ok := n.fsys.(ChmodFS); ok {
+		return errToErrno(fsys.Chmod(name, unixMode(mode)))
+	}
+	return syscall.ENOSYS
+}
+
+func (n *fuseNode) chown(ctx context.Context, name string, uid uint32, gid uint32) syscall.Errno {
+	// Unchanged ids are passed as ^uint32(0), which becomes -1 as in os.Chown.
+	if fsys, ok := n.fsys.(ChownContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(fsys.ChownContext(ctx, name, int(int32(uid)), int(int32(gid))))
+	}
+	if fsys, ok := n.fsys.(ChownFS); ok {
+		return errToErrno(fsys.Chown(name, int(int32(uid)), int(int32(gid))))
+	}
+	return syscall.ENOSYS
+}
+
+func (n *fuseNode) utimens(ctx context.Context, name string, atime *time.Time, mtime *time.Time) syscall.Errno {
+	_, ok1 := n.fsys.(ChtimesContextFS)
+	_, ok2 := n.fsys.(ChtimesFS)
+	if !ok1 && !ok2 {
+		return syscall.ENOSYS
+	}
+	if atime == nil || mtime == nil {
+		fi, err := n.stat(ctx, name)
+		if err != nil {
+			return errToErrno(err)
+		}
+		a, m := fileTimes(fi, atime, mtime)
+		atime, mtime = &a, &m
+	}
+	a, m := *atime, *mtime
+	if fsys, ok := n.fsys.(ChtimesContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(fsys.ChtimesContext(ctx, name, a, m))
+	}
+	return errToErrno(n.fsys.(ChtimesFS).Chtimes(name, a, m))
+}
+
+func (n *fuseNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return 0, errno
+	}
+	var data []byte
+	var err error
+	if fsys, ok := n.fsys.(XattrContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		data, err = fsys.GetXattrContext(ctx, name, attr)
+		cancel()
+	} else if fsys, ok := n.fsys.(XattrFS); ok {
+		data, err = fsys.GetXattr(name, attr)
+	} else {
+		return 0, syscall.ENOSYS
+	}
+	if err != nil {
+		return 0, errToErrno(err)
+	}
+	if len(dest) < len(data) {
+		return uint32(len(data)), syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), fusefs.OK
+}
+
+func (n *fuseNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return errno
+	}
+	if fsys, ok := n.fsys.(XattrContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(fsys.SetXattrContext(ctx, name, attr, data, int(flags)))
+	}
+	if fsys, ok := n.fsys.(XattrFS); ok {
+		return errToErrno(fsys.SetXattr(name, attr, data, int(flags)))
+	}
+	return syscall.ENOSYS
+}
+
+func (n *fuseNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return 0, errno
+	}
+	var attrs []string
+	var err error
+	if fsys, ok := n.fsys.(XattrContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		attrs, err = fsys.ListXattrContext(ctx, name)
+		cancel()
+	} else if fsys, ok := n.fsys.(XattrFS); ok {
+		attrs, err = fsys.ListXattr(name)
+	} else {
+		return 0, syscall.ENOSYS
+	}
+	if err != nil {
+		return 0, errToErrno(err)
+	}
+	var data []byte
+	for _, attr := range attrs {
+		data = append(append(data, attr...), 0)
+	}
+	if len(dest) < len(data) {
+		return uint32(len(data)), syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), fusefs.OK
+}
+
+func (n *fuseNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return errno
+	}
+	if fsys, ok := n.fsys.(XattrContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(fsys.RemoveXattrContext(ctx, name, attr))
+	}
+	if fsys, ok := n.fsys.(XattrFS); ok {
+		return errToErrno(fsys.RemoveXattr(name, attr))
+	}
+	return syscall.ENOSYS
+}
+
+func (n *fuseNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if n.readOnly {
+		return nil, syscall.EROFS
+	}
+	p, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+	var err error
+	if fsys, ok := n.fsys.(MkdirContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		err = fsys.MkdirContext(ctx, p, fs.FileMode(mode))
+		cancel()
+	} else if fsys, ok := n.fsys.(MkdirFS); ok {
+		err = fsys.Mkdir(p, fs.FileMode(mode))
+	} else {
+		return nil, syscall.ENOSYS
+	}
+	if err != nil {
+		return nil, errToErrno(err)
+	}
+
+	fi, err := n.stat(ctx, p)
+	if err == nil {
+		n.fillAttr(fi, &out.Attr)
+	} else {
+		// Some file systems create directories lazily.
+		out.Attr.Mode = fuse.S_IFDIR | mode&07777
+		n.overrideAttr(&out.Attr)
+	}
+	if out.Attr.Mode&syscall.S_IFMT != fuse.S_IFDIR {
+		// go-fuse panics if the new inode is not a directory.
+		return nil, syscall.EIO
+	}
+	return n.NewInode(ctx, &fuseNode{fuseFs: n.fuseFs}, stableAttr(&out.Attr)), fusefs.OK
+}
+
+func (n *fuseNode) remove(ctx context.Context, name string) syscall.Errno {
+	if fsys, ok := n.fsys.(RemoveContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(fsys.RemoveContext(ctx, name))
+	}
+	if fsys, ok := n.fsys.(RemoveFS); ok {
+		return errToErrno(fsys.Remove(name))
+	}
+	return syscall.ENOSYS
+}
+
+func (n *fuseNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	name, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return errno
+	}
+	return n.remove(ctx, name)
+}
+
+func (n *fuseNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	name, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return errno
+	}
+	return n.remove(ctx, name)
+}
+
+func (n *fuseNode) Rename(ctx context.Context, name string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if n.readOnly {
+		return syscall.EROFS
+	}
+	if flags != 0 {
+		return syscall.ENOSYS
+	}
+	oldPath, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return errno
+	}
+	newDir, errno := inodePath(newParent.EmbeddedInode())
+	if errno != fusefs.OK {
+		return errno
+	}
+	newPath := path.Join(newDir, newName)
+	if fsys, ok := n.fsys.(RenameContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		defer cancel()
+		return errToErrno(fsys.RenameContext(ctx, oldPath, newPath))
+	}
+	if fsys, ok := n.fsys.(RenameFS); ok {
+		return errToErrno(fsys.Rename(oldPath, newPath))
+	}
+	return syscall.ENOSYS
+}
 
-	return fuse.ENOSYS
+func (n *fuseNode) Link(ctx context.Context, target fusefs.InodeEmbedder, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if n.readOnly {
+		return nil, syscall.EROFS
+	}
+	oldPath, errno := inodePath(target.EmbeddedInode())
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+	newPath, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+	var err error
+	if fsys, ok := n.fsys.(LinkContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		err = fsys.LinkContext(ctx, oldPath, newPath)
+		cancel()
+	} else if fsys, ok := n.fsys.(LinkFS); ok {
+		err = fsys.Link(oldPath, newPath)
+	} else {
+		return nil, syscall.ENOSYS
+	}
+	if err != nil {
+		return nil, errToErrno(err)
+	}
+	return n.lookupChild(ctx, name, out)
 }
 
-func (f *fuseFs) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
-	if fsys, ok := f.fsys.(MkdirFS); ok {
-		return errToStatus(fsys.Mkdir(name, fs.FileMode(mode)))
+func (n *fuseNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	name, errno := n.path()
+	if errno != fusefs.OK {
+		return nil, errno
 	}
-	return fuse.ENOSYS
+	var target string
+	var err error
+	if fsys, ok := n.fsys.(ReadlinkContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		target, err = fsys.ReadlinkContext(ctx, name)
+		cancel()
+	} else if fsys, ok := n.fsys.(ReadlinkFS); ok {
+		target, err = fsys.Readlink(name)
+	} else {
+		return nil, syscall.ENOSYS
+	}
+	if err != nil {
+		return nil, errToErrno(err)
+	}
+	return []byte(target), fusefs.OK
 }
 
-func (f *fuseFs) Rmdir(name string, context *fuse.Context) fuse.Status {
-	if fsys, ok := f.fsys.(RemoveFS); ok {
-		return errToStatus(fsys.Remove(name))
+func (n *fuseNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if n.readOnly {
+		return nil, syscall.EROFS
+	}
+	newPath, errno := n.childPath(name)
+	if errno != fusefs.OK {
+		return nil, errno
+	}
+	var err error
+	if fsys, ok := n.fsys.(SymlinkContextFS); ok {
+		ctx, cancel := n.canceler.withCancel(ctx)
+		err = fsys.SymlinkContext(ctx, target, newPath)
+		cancel()
+	} else if fsys, ok := n.fsys.(SymlinkFS); ok {
+		err = fsys.Symlink(target, newPath)
+	} else {
+		return nil, syscall.ENOSYS
+	}
+	if err != nil {
+		return nil, errToErrno(err)
 	}
-	return fuse.ENOSYS
+	return n.lookupChild(ctx, name, out)
 }
 
-func (f *fuseFs) Unlink(name string, context *fuse.Context) fuse.Status {
-	if fsys, ok := f.fsys.(RemoveFS); ok {
-		return errToStatus(fsys.Remove(name))
+func (n *fuseNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	const blockSize = 4096
+	out.Bsize = blockSize
+	out.Frsize = blockSize
+	out.NameLen = 255
+	if fsys, ok := n.fsys.(DiskUsageFS); ok {
+		usage, err := fsys.DiskUsage()
+		if err != nil {
+			return errToErrno(err)
+		}
+		out.Blocks = usage.Total / blockSize
+		out.Bfree = usage.Free / blockSize
+		out.Bavail = usage.Available / blockSize
+		out.Files = usage.Files
+		out.Ffree = usage.FreeFiles
+	}
+	return fusefs.OK
+}
+
+// dirStream reads entries from fs.ReadDirFile incrementally.
+type dirStream struct {
+	fsys    *fuseFs
+	dir     fs.ReadDirFile
+	entries []fs.DirEntry
+	err     error
+	dots    int // Number of remaining "." and ".." entries.
+}
+
+func (d *dirStream) HasNext() bool {
+	if d.dots > 0 {
+		return true
+	}
+	if len(d.entries) == 0 && d.err == nil {
+		d.entries, d.err = d.dir.ReadDir(readDirBatchSize)
+		if len(d.entries) == 0 && d.err == nil {
+			d.err = io.EOF
+		}
+	}
+	return len(d.entries) > 0 || d.err != io.EOF
+}
+
+func (d *dirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if d.dots > 0 {
+		name := "."
+		if d.dots == 1 {
+			name = ".."
+		}
+		d.dots--
+		return fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR}, fusefs.OK
+	}
+	if len(d.entries) == 0 {
+		err := d.err
+		d.err = io.EOF
+		return fuse.DirEntry{}, errToErrno(err)
 	}
-	return fuse.ENOSYS
+	f := d.entries[0]
+	d.entries = d.entries[1:]
+
+	entry := fuse.DirEntry{Name: f.Name(), Mode: fileType(f.Type())}
+	if fi, err := f.Info(); err == nil {
+		entry.Ino = d.fsys.fileIno(fi)
+	}
+	return entry, fusefs.OK
 }
 
-func (f *fuseFs) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
-	if fsys, ok := f.fsys.(RenameFS); ok {
-		return errToStatus(fsys.Rename(oldName, newName)) // TODO: newPparent
+func (d *dirStream) Close() {
+	if d.dir != nil {
+		d.dir.Close()
 	}
-	return fuse.ENOSYS
 }
 
 type fuseFile struct {
-	nodefs.File
-	fsys fs.FS
-	path string
+	fsys      fs.FS
+	path      string
+	openFiles *int64 // Counter of open files in the mount.
+	canceler  *canceler
+
+	mu   sync.Mutex // Guards file and pos. Not held by positional reads.
 	file io.Closer
 	pos  int64
+
+	appendMu     *sync.Mutex // Not nil if O_APPEND is emulated. Shared by the handles of the node.
+	nativeAppend bool        // Backend file is opened with O_APPEND.
+	eof          int64       // End of file written by this handle in append mode.
+}
+
+func (f *fuseFile) getFile() io.Closer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file
+}
+
+// stat returns the file info. f.mu must be held.
+func (f *fuseFile) stat() (fs.FileInfo, error) {
+	if st, ok := f.file.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		return st.Stat()
+	}
+	return fs.Stat(f.fsys, f.path)
 }
 
-func (f *fuseFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+func (f *fuseFile) Read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	file := f.getFile()
+	if file == nil {
+		return nil, syscall.EBADF
+	}
+	if r, ok := file.(ReaderAtContext); ok {
+		ctx, cancel := f.canceler.withCancel(ctx)
+		defer cancel()
+		n, err := r.ReadAtContext(ctx, buf, off)
+		return readResult(buf, n, err)
+	}
+	if r, ok := file.(io.ReaderAt); ok {
+		// ReadAt doesn't depend on the current position, so reads can be served in parallel.
+		n, err := r.ReadAt(buf, off)
+		return readResult(buf, n, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.file == nil {
-		return nil, fuse.EBADF
+		return nil, syscall.EBADF
 	}
 	if off == f.pos {
-		if w, ok := f.file.(io.Reader); ok {
-			n, err := w.Read(buf)
+		if r, ok := f.file.(io.Reader); ok {
+			n, err := r.Read(buf)
 			f.pos += int64(n)
-			if err != nil && (n == 0 || err != io.EOF) {
-				return nil, errToStatus(err)
-			}
-			return fuse.ReadResultData(buf[:n]), fuse.OK
+			return readResult(buf, n, err)
 		}
 	}
 
 	f.pos = -1
 	n, err := readAt(f.file, buf, off)
-	if err != nil && (n == 0 || err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF)) {
-		return nil, errToStatus(err)
+	if err == nil {
+		f.pos = off + int64(n)
+	}
+	return readResult(buf, n, err)
+}
+
+func readResult(buf []byte, n int, err error) (fuse.ReadResult, syscall.Errno) {
+	// Reading at the end of file returns no data.
+	if err != nil && err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, errToErrno(err)
 	}
-	return fuse.ReadResultData(buf[:n]), fuse.OK
+	return fuse.ReadResultData(buf[:n]), fusefs.OK
 }
 
-func (f *fuseFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+func (f *fuseFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if f.appendMu != nil {
+		f.appendMu.Lock()
+		defer f.appendMu.Unlock()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.file == nil {
-		return 0, fuse.EBADF
+		return 0, syscall.EBADF
 	}
+	if f.nativeAppend {
+		// Backend writes at the end of file regardless of the offset.
+		w, ok := f.file.(io.Writer)
+		if !ok {
+			return 0, syscall.EBADF
+		}
+		f.pos = -1
+		n, err := w.Write(data)
+		return uint32(n), errToErrno(err)
+	}
+	if f.appendMu != nil {
+		// Write at current end of file.
+		off = f.eof
+		if fi, err := f.stat(); err == nil && fi.Size() > off {
+			off = fi.Size()
+		}
+		n, errno := f.write(data, off)
+		f.eof = off + int64(n)
+		return n, errno
+	}
+	return f.write(data, off)
+}
+
+// write writes data at off. f.mu must be held.
+func (f *fuseFile) write(data []byte, off int64) (uint32, syscall.Errno) {
 	if off == f.pos {
 		if w, ok := f.file.(io.Writer); ok {
 			n, err := w.Write(data)
 			f.pos += int64(n)
-			return uint32(n), errToStatus(err)
+			return uint32(n), errToErrno(err)
 		}
 	}
 	f.pos = -1
 	len, err := writeAt(f.file, data, off)
-	return uint32(len), errToStatus(err)
+	if _, ok := f.file.(io.WriterAt); !ok && err == nil {
+		// writeAt seeked the stream.
+		f.pos = off + int64(len)
+	}
+	return uint32(len), errToErrno(err)
 }
 
-func (f *fuseFile) Truncate(size uint64) fuse.Status {
+func (f *fuseFile) Truncate(size uint64) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.file == nil {
-		return fuse.EBADF
+		return syscall.EBADF
 	}
 	if trunc, ok := f.file.(interface{ Truncate(int64) error }); ok {
-		return errToStatus(trunc.Truncate(int64(size)))
+		return errToErrno(trunc.Truncate(int64(size)))
 	}
-	if trunc, ok := f.fsys.(TruncateFS); ok {
-		return errToStatus(trunc.Truncate(f.path, int64(size)))
+	return syscall.ENOSYS
+}
+
+func (f *fuseFile) Utimens(atime *time.Time, mtime *time.Time) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return syscall.EBADF
 	}
-	return fuse.ENOSYS
+	if ch, ok := f.file.(interface {
+		Chtimes(atime time.Time, mtime time.Time) error
+	}); ok {
+		if atime == nil || mtime == nil {
+			fi, err := f.stat()
+			if err != nil {
+				return errToErrno(err)
+			}
+			a, m := fileTimes(fi, atime, mtime)
+			atime, mtime = &a, &m
+		}
+		return errToErrno(ch.Chtimes(*atime, *mtime))
+	}
+	return syscall.ENOSYS
+}
+
+func (f *fuseFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	if s, ok := f.file.(interface{ Sync() error }); ok {
+		return errToErrno(s.Sync())
+	}
+	return fusefs.OK
+}
+
+// Flush is called on each close(2) of a file descriptor. The file may still be used by duplicated descriptors.
+// Errors of Close() in Release don't reach close(2), so files report their errors by Flush() if needed.
+func (f *fuseFile) Flush(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	if fl, ok := f.file.(interface{ Flush() error }); ok {
+		return errToErrno(fl.Flush())
+	}
+	return fusefs.OK
+}
+
+// Release is called when the last reference to the file is closed.
+func (f *fuseFile) Release(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return syscall.EBADF
+	}
+	err := f.file.Close()
+	f.file = nil
+	if f.openFiles != nil {
+		atomic.AddInt64(f.openFiles, -1)
+	}
+	return errToErrno(err)
 }
 
-func (f *fuseFile) Flush() fuse.Status {
-	if f.file != nil {
-		_ = f.file.Close()
-		f.file = nil
+func callerFromContext(ctx context.Context) (Caller, bool) {
+	c, ok := fuse.FromContext(ctx)
+	if !ok {
+		return Caller{}, false
+	}
+	return Caller{UID: c.Uid, GID: c.Gid, PID: c.Pid}, true
+}
+
+// fileTimes returns atime and mtime, or the current times of fi if they are nil.
+// Backends always get both times since os.Chtimes() before Go 1.21 doesn't ignore zero times.
+func fileTimes(fi fs.FileInfo, atime, mtime *time.Time) (time.Time, time.Time) {
+	a, m := fi.ModTime(), fi.ModTime()
+	if attr := fileAttr(fi); attr != nil && !attr.ATime.IsZero() {
+		a = attr.ATime
+	}
+	if atime != nil {
+		a = *atime
 	}
-	return fuse.OK
+	if mtime != nil {
+		m = *mtime
+	}
+	return a, m
 }
 
 type handle struct {
-	nfs    *pathfs.PathNodeFs
+	*mountState
 	server *fuse.Server
+	root   *fuseNode
+}
+
+func (h *handle) Stats() MountStats {
+	return MountStats{OpenFiles: int(atomic.LoadInt64(&h.root.openFiles))}
+}
+
+// lookup returns the inode of the named file if the kernel may cache it.
+func (h *handle) lookup(op, name string) (*fusefs.Inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	node := h.root.EmbeddedInode()
+	if name == "." {
+		return node, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if node = node.GetChild(elem); node == nil {
+			return nil, nil
+		}
+	}
+	return node, nil
 }
 
-func (h *handle) Close() error {
-	return h.server.Unmount()
+func notifyError(op, name string, errno syscall.Errno) error {
+	if errno == fusefs.OK || errno == syscall.ENOENT {
+		// ENOENT: Not cached in the kernel.
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: errno}
 }
 
-func MountFS(mountPoint string, fsys fs.FS, opt *MountOptions) (MountHandle, error) {
-	nfs := pathfs.NewPathNodeFs(&fuseFs{FileSystem: pathfs.NewDefaultFileSystem(), fsys: fsys}, nil)
-	var mountOpt *nodefs.Options
-	if opt != nil {
-		mountOpt = nodefs.NewOptions()
-		mountOpt.Debug = opt.Debug
+func (h *handle) InvalidatePath(name string) error {
+	node, err := h.lookup("invalidate", name)
+	if node == nil {
+		return err
+	}
+	return notifyError("invalidate", name, node.NotifyContent(0, 0))
+}
+
+func (h *handle) InvalidateData(name string, off, length int64) error {
+	node, err := h.lookup("invalidate", name)
+	if node == nil {
+		return err
+	}
+	if length < 0 {
+		length = 0 // To end of file.
+	}
+	return notifyError("invalidate", name, node.NotifyContent(off, length))
+}
+
+func (h *handle) InvalidateEntry(dir, name string) error {
+	node, err := h.lookup("invalidate", dir)
+	if node == nil {
+		return err
+	}
+	return notifyError("invalidate", path.Join(dir, name), node.NotifyEntry(name))
+}
+
+func mount(mountPoint string, fsys fs.FS, opt *MountOptions) (*handle, error) {
+	timeout := time.Second
+	fsOpt := &fusefs.Options{
+		EntryTimeout:    &timeout,
+		AttrTimeout:     &timeout,
+		NegativeTimeout: opt.NegativeTimeout,
+	}
+	if opt.EntryTimeout != nil {
+		fsOpt.EntryTimeout = opt.EntryTimeout
+	}
+	if opt.AttrTimeout != nil {
+		fsOpt.AttrTimeout = opt.AttrTimeout
+	}
+	if mountOpt, ok := opt.FuseOption.(*fuse.MountOptions); ok && mountOpt != nil {
+		fsOpt.MountOptions = *mountOpt
 	}
-	server, _, err := nodefs.MountRoot(mountPoint, nfs.Root(), mountOpt)
+	if opt.Debug {
+		fsOpt.Debug = true
+	}
+	if opt.AllowOther {
+		fsOpt.AllowOther = true
+	}
+	if opt.FsName != "" {
+		fsOpt.FsName = opt.FsName
+	}
+	if opt.Subtype != "" {
+		fsOpt.Name = opt.Subtype
+	}
+	fsOpt.Options = fsOpt.Options[:len(fsOpt.Options):len(fsOpt.Options)] // Don't modify opt.FuseOption.
+	if opt.ReadOnly {
+		fsOpt.Options = append(fsOpt.Options, "ro")
+	}
+	if opt.VolumeLabel != "" && runtime.GOOS == "darwin" {
+		fsOpt.Options = append(fsOpt.Options, "volname="+opt.VolumeLabel)
+	}
+
+	root := &fuseNode{fuseFs: &fuseFs{
+		fsys:        fsys,
+		readOnly:    opt.ReadOnly,
+		uid:         opt.UID,
+		gid:         opt.GID,
+		umask:       opt.Umask,
+		stageWrites: opt.StageWrites,
+	}}
+	if fi, err := fs.Stat(fsys, "."); err == nil {
+		if attr := fileAttr(fi); attr != nil {
+			root.dev = attr.Dev
+		}
+	}
+	if opt.KeepPageCache {
+		root.openFlags |= fuse.FOPEN_KEEP_CACHE
+	}
+	if opt.DirectIO {
+		root.openFlags |= fuse.FOPEN_DIRECT_IO
+	}
+	server, err := fuse.NewServer(fusefs.NewNodeFS(root, fsOpt), mountPoint, &fsOpt.MountOptions)
 	if err != nil {
 		return nil, err
 	}
-	h := &handle{nfs: nfs, server: server}
-
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
+	unmount := func() error {
+		// Busy requests keep the file system from being unmounted.
+		root.canceler.cancelAll()
+		return server.Unmount()
+	}
+	h := &handle{mountState: newMountState(mountPoint, unmount), server: server, root: root}
 	go func() {
-		defer h.Close()
-		<-sig
-		err := h.Close()
-		if err != nil {
-			fmt.Printf("Failed to unmount %s, you should umount manually: %v\n", mountPoint, err)
-		}
-		os.Exit(1)
+		server.Serve()
+		h.stopped()
 	}()
-
-	go server.Serve()
-	server.WaitMount()
-	return h, err
+	err = server.WaitMount()
+	if err != nil {
+		return nil, err
+	}
+	err = h.watch(fsys, h)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
 }
@@ -0,0 +1,1808 @@
+package fsmount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestXattr(t *testing.T) {
+	targetDir := "testdata"
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "hello.txt")
+
+	err = syscall.Setxattr(fname, "user.test", []byte("value"), 0)
+	if err != nil {
+		t.Fatal("Setxattr() error", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(fname, "user.test", buf)
+	if err != nil {
+		t.Fatal("Getxattr() error", err)
+	}
+	if string(buf[:n]) != "value" {
+		t.Error("Getxattr() should returns value", string(buf[:n]))
+	}
+
+	err = syscall.Removexattr(fname, "user.test")
+	if err != nil {
+		t.Fatal("Removexattr() error", err)
+	}
+
+	_, err = syscall.Getxattr(fname, "user.test", buf)
+	if err == nil {
+		t.Error("Getxattr() should be failed")
+	}
+}
+
+type testDiskUsageFs struct {
+	fs.FS
+}
+
+func (fsys *testDiskUsageFs) DiskUsage() (DiskUsage, error) {
+	return DiskUsage{Total: 1 << 30, Free: 1 << 29, Available: 1 << 28, Files: 1000, FreeFiles: 100}, nil
+}
+
+func TestStatFs(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testDiskUsageFs{FS: os.DirFS("testdata")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	var st syscall.Statfs_t
+	err = syscall.Statfs(mountPoint, &st)
+	if err != nil {
+		t.Fatal("Statfs() error", err)
+	}
+	if uint64(st.Blocks)*uint64(st.Bsize) != 1<<30 {
+		t.Error("Total size should be 1GiB", st.Blocks, st.Bsize)
+	}
+	if uint64(st.Bavail)*uint64(st.Bsize) != 1<<28 {
+		t.Error("Available size should be 256MiB", st.Bavail, st.Bsize)
+	}
+	if st.Files != 1000 || st.Ffree != 100 {
+		t.Error("Files should be 1000/100", st.Files, st.Ffree)
+	}
+}
+
+type testOpenDirFs struct {
+	fstest.MapFS
+	opened int32
+}
+
+func (fsys *testOpenDirFs) OpenDir(name string) (fs.ReadDirFile, error) {
+	atomic.AddInt32(&fsys.opened, 1)
+	f, err := fsys.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.(fs.ReadDirFile), nil
+}
+
+func TestOpenDir(t *testing.T) {
+	const numFiles = 1000
+	fsys := &testOpenDirFs{MapFS: fstest.MapFS{}}
+	for i := 0; i < numFiles; i++ {
+		fsys.MapFS[fmt.Sprintf("dir/file%04d.txt", i)] = &fstest.MapFile{Data: []byte("test"), Mode: 0644}
+	}
+
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	f, err := os.Open(filepath.Join(mountPoint, "dir"))
+	if err != nil {
+		t.Fatal("Open() error", err)
+	}
+	defer f.Close()
+
+	files, err := f.ReadDir(10)
+	if err != nil {
+		t.Fatal("ReadDir() error", err)
+	}
+	if len(files) != 10 {
+		t.Error("ReadDir() should returns 10 entries", len(files))
+	}
+
+	// rewinddir
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal("Seek() error", err)
+	}
+
+	files, err = f.ReadDir(-1)
+	if err != nil {
+		t.Fatal("ReadDir() error", err)
+	}
+	if len(files) != numFiles {
+		t.Error("ReadDir() should returns all entries", len(files))
+	}
+	if atomic.LoadInt32(&fsys.opened) == 0 {
+		t.Error("OpenDir() should be called")
+	}
+}
+
+type testErrno syscall.Errno
+
+func (e testErrno) Error() string {
+	return "test error"
+}
+
+func (e testErrno) Errno() syscall.Errno {
+	return syscall.Errno(e)
+}
+
+type testErrorFs struct {
+	fs.FS
+}
+
+func (fsys *testErrorFs) Open(name string) (fs.File, error) {
+	switch name {
+	case "busy":
+		return nil, &fs.PathError{Op: "open", Path: name, Err: testErrno(syscall.EBUSY)}
+	case "unknown":
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("unknown")}
+	}
+	return fsys.FS.Open(name)
+}
+
+func TestErrno(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testErrorFs{FS: os.DirFS("testdata")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	_, err = os.Stat(filepath.Join(mountPoint, "busy"))
+	if !errors.Is(err, syscall.EBUSY) {
+		t.Error("Stat() should fail with EBUSY", err)
+	}
+
+	_, err = os.Stat(filepath.Join(mountPoint, "unknown"))
+	if !errors.Is(err, syscall.EIO) {
+		t.Error("Stat() should fail with EIO", err)
+	}
+}
+
+type testOpenFileFs struct {
+	*testWritableFs
+}
+
+func (fsys *testOpenFileFs) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return os.OpenFile(filepath.Join(fsys.path, name), flag, perm)
+}
+
+func TestOpenFile(t *testing.T) {
+	targetDir := "testdata"
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testOpenFileFs{&testWritableFs{FS: os.DirFS(targetDir), path: targetDir}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "rw.txt")
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal("OpenFile() error", err)
+	}
+	defer os.Remove(fname)
+
+	_, err = f.Write([]byte("hello, FUSE!"))
+	if err != nil {
+		t.Fatal("Write() error", err)
+	}
+
+	buf := make([]byte, 5)
+	_, err = f.ReadAt(buf, 7)
+	if err != nil {
+		t.Fatal("ReadAt() error", err)
+	}
+	if string(buf) != "FUSE!" {
+		t.Error("ReadAt() should returns FUSE!", string(buf))
+	}
+
+	err = f.Sync()
+	if err != nil {
+		t.Error("Sync() error", err)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if stat.Size() != 12 {
+		t.Error("Size() should returns 12", stat.Size())
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal("Close() error", err)
+	}
+}
+
+type testAppendFs struct {
+	*testWritableFs
+}
+
+func (fsys *testAppendFs) SupportsAppend() bool {
+	return true
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	targetDir := "testdata"
+	for _, fsys := range []fs.FS{
+		&testWritableFs{FS: os.DirFS(targetDir), path: targetDir},
+		&testAppendFs{&testWritableFs{FS: os.DirFS(targetDir), path: targetDir}},
+	} {
+		mountPoint, err := os.MkdirTemp("", "testmount")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(mountPoint)
+		t.Log("Mount point:", mountPoint)
+
+		mount, err := MountFS(mountPoint, fsys, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mount.Close()
+		time.Sleep(10 * time.Millisecond)
+
+		fname := filepath.Join(mountPoint, "append.txt")
+		_ = os.Remove(fname)
+
+		f1, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal("OpenFile() error", err)
+		}
+		// Another writer which is not visible to the kernel.
+		f2, err := os.OpenFile(filepath.Join(targetDir, "append.txt"), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal("OpenFile() error", err)
+		}
+
+		const lines = 20
+		line := "0123456789\n"
+		for i := 0; i < lines; i++ {
+			if _, err := f1.Write([]byte(line)); err != nil {
+				t.Fatal("Write() error", err)
+			}
+			if _, err := f2.Write([]byte(line)); err != nil {
+				t.Fatal("Write() error", err)
+			}
+		}
+		f1.Close()
+		f2.Close()
+
+		b, err := os.ReadFile(filepath.Join(targetDir, "append.txt"))
+		if err != nil {
+			t.Fatal("ReadFile() error", err)
+		}
+		if string(b) != strings.Repeat(line, lines*2) {
+			t.Error("Appended content is broken", len(b))
+		}
+
+		err = os.Remove(fname)
+		if err != nil {
+			t.Error("Remove() error", err)
+		}
+	}
+}
+
+type testFlushErrorFile struct {
+	*os.File
+}
+
+func (f *testFlushErrorFile) Flush() error {
+	return testErrno(syscall.ENOSPC)
+}
+
+type testSyncErrorFile struct {
+	*os.File
+}
+
+func (f *testSyncErrorFile) Sync() error {
+	return testErrno(syscall.EDQUOT)
+}
+
+type testFlushErrorFs struct {
+	*testWritableFs
+}
+
+func (fsys *testFlushErrorFs) OpenWriter(name string, flag int) (io.WriteCloser, error) {
+	f, err := fsys.testWritableFs.OpenWriter(name, flag)
+	if err != nil {
+		return f, err
+	}
+	switch name {
+	case "flusherr.txt":
+		return &testFlushErrorFile{File: f.(*os.File)}, nil
+	case "syncerr.txt":
+		return &testSyncErrorFile{File: f.(*os.File)}, nil
+	}
+	return f, nil
+}
+
+func TestFlush(t *testing.T) {
+	targetDir := "testdata"
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testFlushErrorFs{&testWritableFs{FS: os.DirFS(targetDir), path: targetDir}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "dup.txt")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal("Create() error", err)
+	}
+	defer os.Remove(fname)
+
+	// Closing a duplicated fd should not close the file.
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal("Dup() error", err)
+	}
+	err = syscall.Close(fd)
+	if err != nil {
+		t.Fatal("Close() error", err)
+	}
+
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Error("Write() error", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Error("Close() error", err)
+	}
+
+	fname = filepath.Join(mountPoint, "flusherr.txt")
+	f, err = os.Create(fname)
+	if err != nil {
+		t.Fatal("Create() error", err)
+	}
+	defer os.Remove(fname)
+	err = f.Close()
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Error("Close() should fail with ENOSPC", err)
+	}
+
+	fname = filepath.Join(mountPoint, "syncerr.txt")
+	f, err = os.Create(fname)
+	if err != nil {
+		t.Fatal("Create() error", err)
+	}
+	defer os.Remove(fname)
+	err = f.Sync()
+	if !errors.Is(err, syscall.EDQUOT) {
+		t.Error("Sync() should fail with EDQUOT", err)
+	}
+	// Close() doesn't call Sync().
+	err = f.Close()
+	if err != nil {
+		t.Error("Close() error", err)
+	}
+}
+
+type testStreamFile struct {
+	f *os.File
+}
+
+func (f *testStreamFile) Stat() (fs.FileInfo, error) {
+	return f.f.Stat()
+}
+
+func (f *testStreamFile) Read(b []byte) (int, error) {
+	return f.f.Read(b)
+}
+
+func (f *testStreamFile) Write(b []byte) (int, error) {
+	return f.f.Write(b)
+}
+
+func (f *testStreamFile) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+func (f *testStreamFile) Close() error {
+	return f.f.Close()
+}
+
+func TestConcurrentRead(t *testing.T) {
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	fname := filepath.Join(t.TempDir(), "data.bin")
+	err := os.WriteFile(fname, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range []bool{false, true} {
+		osf, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := &fuseFile{file: osf}
+		if stream {
+			f.file = &testStreamFile{osf}
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(seed int) {
+				defer wg.Done()
+				buf := make([]byte, 4096)
+				for j := 0; j < 200; j++ {
+					off := int64((seed*7919 + j*104729) % len(data))
+					if j%4 == 0 {
+						off -= off % int64(len(buf))
+					}
+					res, errno := f.Read(context.Background(), buf, off)
+					if errno != 0 {
+						t.Error("Read() error", errno)
+						return
+					}
+					b, _ := res.Bytes(buf)
+					end := off + int64(len(buf))
+					if end > int64(len(data)) {
+						end = int64(len(data))
+					}
+					if !bytes.Equal(b, data[off:end]) {
+						t.Errorf("Read() unexpected data. stream:%v off:%v", stream, off)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if errno := f.Release(context.Background()); errno != 0 {
+			t.Error("Release() error", errno)
+		}
+	}
+}
+
+func TestConcurrentWrite(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "data.bin")
+	osf, err := os.Create(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fuseFile{file: &testStreamFile{osf}}
+
+	const blockSize = 1000
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			block := bytes.Repeat([]byte{byte('a' + n)}, blockSize)
+			for j := 0; j < 10; j++ {
+				off := int64((j*16 + n) * blockSize)
+				_, errno := f.Write(context.Background(), block, off)
+				if errno != 0 {
+					t.Error("Write() error", errno)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if errno := f.Release(context.Background()); errno != 0 {
+		t.Error("Release() error", errno)
+	}
+
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 160*blockSize {
+		t.Fatal("unexpected size", len(b))
+	}
+	for i := 0; i < 160; i++ {
+		if !bytes.Equal(b[i*blockSize:(i+1)*blockSize], bytes.Repeat([]byte{byte('a' + i%16)}, blockSize)) {
+			t.Fatal("unexpected data at block", i)
+		}
+	}
+}
+
+type testStreamOnlyFs struct {
+	fstest.MapFS
+}
+
+func (fsys testStreamOnlyFs) Open(name string) (fs.File, error) {
+	f, err := fsys.MapFS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// Hide io.ReaderAt and io.Seeker.
+	return struct{ fs.File }{f}, nil
+}
+
+func TestStreamOnlyFile(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	fsys := testStreamOnlyFs{fstest.MapFS{"stream.bin": &fstest.MapFile{Data: data, Mode: 0644}}}
+
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	mount, err := MountFS(mountPoint, fsys, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	f, err := os.Open(filepath.Join(mountPoint, "stream.bin"))
+	if err != nil {
+		t.Fatal("Open() error", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 10000)
+	for _, off := range []int64{500000, 0, 12345, 1024*1024 - 5000, 300000} {
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			t.Fatal("ReadAt() error", err)
+		}
+		if !bytes.Equal(buf[:n], data[off:off+int64(n)]) || off+int64(n) != int64(len(data)) && n != len(buf) {
+			t.Error("ReadAt() unexpected data. off:", off)
+		}
+	}
+}
+
+type testUploadWriter struct {
+	path   string
+	buf    bytes.Buffer
+	reject bool
+}
+
+func (w *testUploadWriter) Write(b []byte) (int, error) {
+	return w.buf.Write(b)
+}
+
+func (w *testUploadWriter) Close() error {
+	if w.reject {
+		return testErrno(syscall.EDQUOT)
+	}
+	return os.WriteFile(w.path, w.buf.Bytes(), 0644)
+}
+
+// testUploadFs accepts only sequential writes.
+type testUploadFs struct {
+	*testWritableFs
+}
+
+func (fsys *testUploadFs) OpenWriter(name string, flag int) (io.WriteCloser, error) {
+	return &testUploadWriter{path: filepath.Join(fsys.path, name), reject: name == "reject.txt"}, nil
+}
+
+func TestStageWrites(t *testing.T) {
+	targetDir := "testdata"
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	fsys := &testUploadFs{&testWritableFs{FS: os.DirFS(targetDir), path: targetDir}}
+	mount, err := MountFS(mountPoint, fsys, &MountOptions{StageWrites: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "staged.txt")
+	f, err := os.Create(fname)
+	if err != nil {
+		t.Fatal("Create() error", err)
+	}
+	defer os.Remove(fname)
+
+	_, err = f.WriteAt([]byte("FUSE!"), 7)
+	if err != nil {
+		t.Fatal("WriteAt() error", err)
+	}
+	_, err = f.WriteAt([]byte("hello, "), 0)
+	if err != nil {
+		t.Fatal("WriteAt() error", err)
+	}
+
+	fi, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if fi.Size() != 12 {
+		t.Error("staged size should be visible", fi.Size())
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal("Close() error", err)
+	}
+
+	// The file is uploaded on close(2).
+	if b, _ := os.ReadFile(filepath.Join(targetDir, "staged.txt")); string(b) != "hello, FUSE!" {
+		t.Error("unexpected content", string(b))
+	}
+
+	// The staged file is released asynchronously to close(2).
+	node, _ := mount.(*handle).lookup("test", "staged.txt")
+	if node == nil {
+		t.Fatal("inode is not cached")
+	}
+	n := node.Operations().(*fuseNode)
+	for i := 0; ; i++ {
+		n.mu.Lock()
+		staged := n.staged
+		n.mu.Unlock()
+		if staged == nil {
+			break
+		}
+		if i == 100 {
+			t.Error("staged file should be cleared on release")
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Rewrite a part of the existing file.
+	f, err = os.OpenFile(fname, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal("OpenFile() error", err)
+	}
+	_, err = f.WriteAt([]byte("HELLO"), 0)
+	if err != nil {
+		t.Fatal("WriteAt() error", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal("Close() error", err)
+	}
+
+	if b, _ := os.ReadFile(filepath.Join(targetDir, "staged.txt")); string(b) != "HELLO, FUSE!" {
+		t.Error("unexpected content", string(b))
+	}
+
+	// Writes through a duplicated fd after close(2) are uploaded again.
+	f, err = os.OpenFile(fname, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal("OpenFile() error", err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal("Dup() error", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal("Close() error", err)
+	}
+	_, err = syscall.Pwrite(fd, []byte("fuse"), 7)
+	if err != nil {
+		t.Fatal("Pwrite() error", err)
+	}
+	err = syscall.Close(fd)
+	if err != nil {
+		t.Fatal("Close() error", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(targetDir, "staged.txt")); string(b) != "HELLO, fuse!" {
+		t.Error("unexpected content", string(b))
+	}
+
+	// Upload errors are reported to close(2).
+	f, err = os.Create(filepath.Join(mountPoint, "reject.txt"))
+	if err != nil {
+		t.Fatal("Create() error", err)
+	}
+	_, err = f.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal("Write() error", err)
+	}
+	err = f.Close()
+	if !errors.Is(err, syscall.EDQUOT) {
+		t.Error("Close() should fail with the error of upload", err)
+	}
+}
+
+func TestCacheOptions(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	var noCache time.Duration
+	opt := &MountOptions{
+		AttrTimeout:     &noCache,
+		EntryTimeout:    &noCache,
+		NegativeTimeout: &noCache,
+		DirectIO:        true,
+		FuseOption:      &fuse.MountOptions{FsName: "fsmounttest"},
+	}
+	mount, err := MountFS(mountPoint, os.DirFS(targetDir), opt)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	mounts, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(mounts), "fsmounttest "+mountPoint) {
+		t.Error("FsName is not applied")
+	}
+
+	fname := filepath.Join(mountPoint, "live.txt")
+	_, err = os.Stat(fname)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal("Stat() should fail", err)
+	}
+
+	for _, content := range []string{"hello", "hello, world", "HELLO"} {
+		err = os.WriteFile(filepath.Join(targetDir, "live.txt"), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal("Stat() error", err)
+		}
+		if fi.Size() != int64(len(content)) {
+			t.Error("Stat() returns cached size", fi.Size())
+		}
+		b, err := os.ReadFile(fname)
+		if err != nil {
+			t.Fatal("ReadFile() error", err)
+		}
+		if string(b) != content {
+			t.Error("ReadFile() returns cached data", string(b))
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	err = os.Mkdir(filepath.Join(targetDir, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(targetDir, "dir", "file.txt"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(targetDir, "dir", "old.txt"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longTimeout := time.Hour
+	opt := &MountOptions{
+		AttrTimeout:   &longTimeout,
+		EntryTimeout:  &longTimeout,
+		KeepPageCache: true,
+	}
+	mount, err := MountFS(mountPoint, os.DirFS(targetDir), opt)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "dir", "file.txt")
+	if fi, err := os.Stat(fname); err != nil || fi.Size() != 5 {
+		t.Fatal("Stat() error", err)
+	}
+
+	// Check attributes before reading files. Reading invalidates atime in the kernel.
+	err = os.WriteFile(filepath.Join(targetDir, "dir", "file.txt"), []byte("hello, world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Size() != 5 {
+		t.Fatal("Stat() should return cached attributes", err)
+	}
+	err = mount.InvalidatePath("dir/file.txt")
+	if err != nil {
+		t.Error("InvalidatePath() error", err)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Size() != 12 {
+		t.Error("Stat() should return new attributes", err)
+	}
+
+	// Entries
+	oldName := filepath.Join(mountPoint, "dir", "old.txt")
+	if _, err := os.Stat(oldName); err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	err = os.Remove(filepath.Join(targetDir, "dir", "old.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldName); err != nil {
+		t.Fatal("Stat() should return cached entry", err)
+	}
+	err = mount.InvalidateEntry("dir", "old.txt")
+	if err != nil {
+		t.Error("InvalidateEntry() error", err)
+	}
+	if _, err := os.Stat(oldName); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("Stat() should fail", err)
+	}
+
+	// Data
+	b, err := os.ReadFile(fname)
+	if err != nil || string(b) != "hello, world" {
+		t.Fatal("ReadFile() error", string(b), err)
+	}
+	err = os.WriteFile(filepath.Join(targetDir, "dir", "file.txt"), []byte("HELLO, WORLD"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mount.InvalidateData("dir/file.txt", 0, -1)
+	if err != nil {
+		t.Error("InvalidateData() error", err)
+	}
+	b, err = os.ReadFile(fname)
+	if err != nil || string(b) != "HELLO, WORLD" {
+		t.Error("ReadFile() should return new data", string(b), err)
+	}
+
+	// Not cached or invalid names.
+	err = mount.InvalidatePath("notexist/file.txt")
+	if err != nil {
+		t.Error("InvalidatePath() error", err)
+	}
+	err = mount.InvalidatePath("/dir")
+	if !errors.Is(err, fs.ErrInvalid) {
+		t.Error("InvalidatePath() should fail", err)
+	}
+}
+
+type testWatchFs struct {
+	fs.FS
+	events  chan ChangeEvent
+	stopped chan struct{}
+}
+
+func (fsys *testWatchFs) Watch(ctx context.Context) (<-chan ChangeEvent, error) {
+	ch := make(chan ChangeEvent)
+	go func() {
+		defer close(ch)
+		defer close(fsys.stopped)
+		for {
+			select {
+			case ev := <-fsys.events:
+				ch <- ev
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func TestWatch(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	err = os.WriteFile(filepath.Join(targetDir, "file.txt"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := &testWatchFs{FS: os.DirFS(targetDir), events: make(chan ChangeEvent), stopped: make(chan struct{})}
+	longTimeout := time.Hour
+	mount, err := MountFS(mountPoint, fsys, &MountOptions{AttrTimeout: &longTimeout, EntryTimeout: &longTimeout})
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "file.txt")
+	if fi, err := os.Stat(fname); err != nil || fi.Size() != 5 {
+		t.Fatal("Stat() error", err)
+	}
+	err = os.WriteFile(filepath.Join(targetDir, "file.txt"), []byte("hello, world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.events <- ChangeEvent{Name: "file.txt", Kind: ChangeModify}
+	time.Sleep(10 * time.Millisecond)
+	if fi, err := os.Stat(fname); err != nil || fi.Size() != 12 {
+		t.Error("Stat() should return new attributes", err)
+	}
+
+	err = os.Remove(filepath.Join(targetDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.events <- ChangeEvent{Name: "file.txt", Kind: ChangeRemove}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := os.Stat(fname); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("Stat() should fail", err)
+	}
+
+	err = mount.Close()
+	if err != nil {
+		t.Error("Close() error", err)
+	}
+	select {
+	case <-fsys.stopped:
+	case <-time.After(time.Second):
+		t.Error("Watch() should be stopped on Close()")
+	}
+}
+
+func TestMountFSContext(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mount, err := MountFSContext(ctx, mountPoint, os.DirFS("testdata"), nil)
+	if err != nil {
+		t.Fatal("MountFSContext() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	mounted := func() bool {
+		mounts, _ := os.ReadFile("/proc/mounts")
+		return strings.Contains(string(mounts), " "+mountPoint+" ")
+	}
+	if !mounted() {
+		t.Fatal("not mounted")
+	}
+
+	// Busy file system is unmounted after the file is closed.
+	f, err := os.Open(filepath.Join(mountPoint, "hello.txt"))
+	if err != nil {
+		t.Fatal("Open() error", err)
+	}
+	cancel()
+	time.Sleep(500 * time.Millisecond)
+	if !mounted() {
+		t.Error("busy file system should not be unmounted")
+	}
+	f.Close()
+
+	select {
+	case <-mount.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("should be unmounted when the context is done")
+	}
+	if mounted() {
+		t.Error("should be unmounted when the context is done")
+	}
+	if err := mount.Wait(); err != context.Canceled {
+		t.Error("Wait() should return context.Canceled", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	mount, err := MountFS(mountPoint, os.DirFS("testdata"), nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if mount.MountPoint() != mountPoint {
+		t.Error("MountPoint() unexpected value", mount.MountPoint())
+	}
+
+	f, err := os.Open(filepath.Join(mountPoint, "hello.txt"))
+	if err != nil {
+		t.Fatal("Open() error", err)
+	}
+	if n := mount.Stats().OpenFiles; n != 1 {
+		t.Error("Stats().OpenFiles should be 1", n)
+	}
+	f.Close()
+	for i := 0; i < 100 && mount.Stats().OpenFiles != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := mount.Stats().OpenFiles; n != 0 {
+		t.Error("Stats().OpenFiles should be 0", n)
+	}
+
+	select {
+	case <-mount.Done():
+		t.Fatal("Done() should not be closed")
+	default:
+	}
+
+	// Unmount externally.
+	out, err := exec.Command("fusermount", "-u", mountPoint).CombinedOutput()
+	if err != nil {
+		t.Fatal("fusermount error", err, string(out))
+	}
+	select {
+	case <-mount.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done() should be closed")
+	}
+	if err := mount.Wait(); err != ErrUnmounted {
+		t.Error("Wait() should return ErrUnmounted", err)
+	}
+	if err := mount.Close(); err != nil {
+		t.Error("Close() error", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	err = os.WriteFile(filepath.Join(targetDir, "file.txt"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}
+	mount, err := MountFS(mountPoint, fsys, &MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "file.txt")
+	b, err := os.ReadFile(fname)
+	if err != nil || string(b) != "hello" {
+		t.Error("ReadFile() error", err)
+	}
+
+	ops := map[string]func() error{
+		"Create":   func() error { return os.WriteFile(filepath.Join(mountPoint, "new.txt"), nil, 0644) },
+		"OpenFile": func() error { _, err := os.OpenFile(fname, os.O_WRONLY, 0); return err },
+		"Truncate": func() error { return os.Truncate(fname, 0) },
+		"Chmod":    func() error { return os.Chmod(fname, 0600) },
+		"Mkdir":    func() error { return os.Mkdir(filepath.Join(mountPoint, "dir"), 0755) },
+		"Remove":   func() error { return os.Remove(fname) },
+		"Rename":   func() error { return os.Rename(fname, filepath.Join(mountPoint, "renamed.txt")) },
+		"Symlink":  func() error { return os.Symlink("file.txt", filepath.Join(mountPoint, "link")) },
+	}
+	for name, op := range ops {
+		if err := op(); !errors.Is(err, syscall.EROFS) {
+			t.Error(name, "should fail with EROFS", err)
+		}
+	}
+
+	// Operations should be refused even if the kernel doesn't check.
+	n := &fuseNode{fuseFs: &fuseFs{fsys: fsys, readOnly: true}}
+	if _, _, errno := n.Open(context.Background(), uint32(os.O_RDWR)); errno != syscall.EROFS {
+		t.Error("Open() should fail with EROFS", errno)
+	}
+	if errno := n.Unlink(context.Background(), "file.txt"); errno != syscall.EROFS {
+		t.Error("Unlink() should fail with EROFS", errno)
+	}
+
+	b, err = os.ReadFile(filepath.Join(targetDir, "file.txt"))
+	if err != nil || string(b) != "hello" {
+		t.Error("file should not be modified", string(b), err)
+	}
+}
+
+func TestOwnerOptions(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	uid, gid := uint32(1234), uint32(5678)
+	opt := &MountOptions{
+		AllowOther: true,
+		FsName:     "testfs",
+		Subtype:    "fsmounttest",
+		UID:        &uid,
+		GID:        &gid,
+		Umask:      0027,
+	}
+	mount, err := MountFS(mountPoint, os.DirFS("testdata"), opt)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	mounts, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry string
+	for _, line := range strings.Split(string(mounts), "\n") {
+		if strings.Contains(line, " "+mountPoint+" ") {
+			entry = line
+		}
+	}
+	if !strings.HasPrefix(entry, "testfs "+mountPoint+" fuse.fsmounttest ") {
+		t.Error("FsName or Subtype is not applied", entry)
+	}
+	if !strings.Contains(entry, "allow_other") {
+		t.Error("AllowOther is not applied", entry)
+	}
+
+	for _, name := range []string{".", "hello.txt"} {
+		fi, err := os.Stat(filepath.Join(mountPoint, name))
+		if err != nil {
+			t.Fatal("Stat() error", err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != uid || st.Gid != gid {
+			t.Error("owner is not overridden", name, st.Uid, st.Gid)
+		}
+		if fi.Mode().Perm()&0027 != 0 {
+			t.Error("umask is not applied", name, fi.Mode())
+		}
+	}
+}
+
+type testContextFs struct {
+	*testWritableFs
+	mu  sync.Mutex
+	log []string
+}
+
+func (fsys *testContextFs) record(ctx context.Context, op, name string) {
+	caller, ok := CallerFromContext(ctx)
+	if !ok {
+		caller.PID = 0xffffffff
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.log = append(fsys.log, fmt.Sprintf("%s %s %d %d", op, name, caller.UID, caller.PID))
+}
+
+func (fsys *testContextFs) OpenWriterContext(ctx context.Context, name string, flag int) (io.WriteCloser, error) {
+	fsys.record(ctx, "write", name)
+	return fsys.OpenWriter(name, flag)
+}
+
+func (fsys *testContextFs) MkdirContext(ctx context.Context, name string, mode fs.FileMode) error {
+	fsys.record(ctx, "mkdir", name)
+	return fsys.Mkdir(name, mode)
+}
+
+func (fsys *testContextFs) RemoveContext(ctx context.Context, name string) error {
+	fsys.record(ctx, "remove", name)
+	return fsys.Remove(name)
+}
+
+func (fsys *testContextFs) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	fsys.record(ctx, "open", name)
+	return fsys.Open(name)
+}
+
+func (fsys *testContextFs) OpenDirContext(ctx context.Context, name string) (fs.ReadDirFile, error) {
+	fsys.record(ctx, "opendir", name)
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.(fs.ReadDirFile), nil
+}
+
+func (fsys *testContextFs) ReadlinkContext(ctx context.Context, name string) (string, error) {
+	fsys.record(ctx, "readlink", name)
+	return fsys.Readlink(name)
+}
+
+func (fsys *testContextFs) LstatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	// Not recorded. Called for each lookup.
+	return fsys.Lstat(name)
+}
+
+func (fsys *testContextFs) SymlinkContext(ctx context.Context, oldname, newname string) error {
+	fsys.record(ctx, "symlink", newname)
+	return fsys.Symlink(oldname, newname)
+}
+
+func (fsys *testContextFs) LinkContext(ctx context.Context, oldname, newname string) error {
+	fsys.record(ctx, "link", newname)
+	return fsys.Link(oldname, newname)
+}
+
+func (fsys *testContextFs) GetXattrContext(ctx context.Context, name string, attr string) ([]byte, error) {
+	return fsys.GetXattr(name, attr)
+}
+
+func (fsys *testContextFs) SetXattrContext(ctx context.Context, name string, attr string, data []byte, flags int) error {
+	fsys.record(ctx, "setxattr", name)
+	return fsys.SetXattr(name, attr, data, flags)
+}
+
+func (fsys *testContextFs) ListXattrContext(ctx context.Context, name string) ([]string, error) {
+	return fsys.ListXattr(name)
+}
+
+func (fsys *testContextFs) RemoveXattrContext(ctx context.Context, name string, attr string) error {
+	fsys.record(ctx, "removexattr", name)
+	return fsys.RemoveXattr(name, attr)
+}
+
+func TestCallerFromContext(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	fsys := &testContextFs{testWritableFs: &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}}
+	mount, err := MountFS(mountPoint, fsys, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	err = os.WriteFile(filepath.Join(mountPoint, "file.txt"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal("WriteFile() error", err)
+	}
+	_, err = os.ReadFile(filepath.Join(mountPoint, "file.txt"))
+	if err != nil {
+		t.Fatal("ReadFile() error", err)
+	}
+	_, err = os.ReadDir(mountPoint)
+	if err != nil {
+		t.Fatal("ReadDir() error", err)
+	}
+	err = os.Mkdir(filepath.Join(mountPoint, "dir"), 0755)
+	if err != nil {
+		t.Fatal("Mkdir() error", err)
+	}
+	err = os.Remove(filepath.Join(mountPoint, "dir"))
+	if err != nil {
+		t.Fatal("Remove() error", err)
+	}
+	err = os.Symlink("file.txt", filepath.Join(mountPoint, "symlink"))
+	if err != nil {
+		t.Fatal("Symlink() error", err)
+	}
+	_, err = os.Readlink(filepath.Join(mountPoint, "symlink"))
+	if err != nil {
+		t.Fatal("Readlink() error", err)
+	}
+	err = syscall.Setxattr(filepath.Join(mountPoint, "file.txt"), "user.test", []byte("value"), 0)
+	if err != nil {
+		t.Fatal("Setxattr() error", err)
+	}
+	err = syscall.Removexattr(filepath.Join(mountPoint, "file.txt"), "user.test")
+	if err != nil {
+		t.Fatal("Removexattr() error", err)
+	}
+
+	err = os.Link(filepath.Join(mountPoint, "file.txt"), filepath.Join(mountPoint, "hardlink"))
+	if err != nil {
+		t.Fatal("Link() error", err)
+	}
+	expected := []string{"write file.txt", "open file.txt", "opendir .", "mkdir dir", "remove dir",
+		"symlink symlink", "readlink symlink", "setxattr file.txt", "removexattr file.txt", "link hardlink"}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if len(fsys.log) != len(expected) {
+		t.Fatal("unexpected log", fsys.log)
+	}
+	for i, entry := range fsys.log {
+		var op, name string
+		var uid, pid int
+		fmt.Sscan(entry, &op, &name, &uid, &pid)
+		if op+" "+name != expected[i] || uid != os.Getuid() {
+			t.Error("unexpected log", entry)
+		}
+		// PID is the thread ID of the caller.
+		if _, err := os.Stat(fmt.Sprintf("/proc/self/task/%d", pid)); err != nil {
+			t.Error("PID should be a thread of this process", entry)
+		}
+	}
+
+	if _, ok := CallerFromContext(context.Background()); ok {
+		t.Error("CallerFromContext() should fail")
+	}
+}
+
+type testSlowFs struct {
+	fs.FS
+	called chan struct{}
+	errs   chan error
+}
+
+func (fsys *testSlowFs) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	if name != "slow.txt" {
+		return fs.Stat(fsys.FS, name)
+	}
+	fsys.called <- struct{}{}
+	<-ctx.Done()
+	fsys.errs <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestCancel(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	fsys := &testSlowFs{FS: fstest.MapFS{}, called: make(chan struct{}, 1), errs: make(chan error, 1)}
+	mount, err := MountFS(mountPoint, fsys, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	startStat := func() *exec.Cmd {
+		cmd := exec.Command("stat", filepath.Join(mountPoint, "slow.txt"))
+		if err := cmd.Start(); err != nil {
+			t.Fatal("stat error", err)
+		}
+		select {
+		case <-fsys.called:
+		case <-time.After(5 * time.Second):
+			t.Fatal("StatContext() is not called")
+		}
+		return cmd
+	}
+	waitCanceled := func() {
+		select {
+		case err := <-fsys.errs:
+			if err != context.Canceled {
+				t.Error("unexpected error", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("context is not canceled")
+		}
+	}
+
+	// Interrupted by a signal.
+	cmd := startStat()
+	cmd.Process.Signal(os.Interrupt)
+	waitCanceled()
+	cmd.Wait()
+
+	// Canceled by unmount.
+	cmd = startStat()
+	closed := make(chan error, 1)
+	go func() { closed <- mount.Close() }()
+	waitCanceled()
+	if err := cmd.Wait(); err == nil {
+		t.Error("stat should fail")
+	}
+	if err := <-closed; err != nil {
+		t.Error("Close() error", err)
+	}
+}
+
+func TestAttr(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	atime := time.Date(2021, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	mtime := time.Date(2022, 1, 2, 3, 4, 5, 987654321, time.UTC)
+	err = os.WriteFile(filepath.Join(targetDir, "file.txt"), bytes.Repeat([]byte("a"), 10000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(filepath.Join(targetDir, "file.txt"), atime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mount, err := MountFS(mountPoint, os.DirFS(targetDir), nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Don't read the file before stat. Reading updates atime.
+	var src, st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(targetDir, "file.txt"), &src); err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Stat(filepath.Join(mountPoint, "file.txt"), &st)
+	mount.Close()
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if st.Ino != src.Ino || st.Uid != src.Uid || st.Gid != src.Gid || st.Nlink != src.Nlink || st.Blocks != src.Blocks {
+		t.Errorf("unexpected attributes %+v, expected %+v", st, src)
+	}
+	if st.Atim != src.Atim || st.Mtim != src.Mtim || st.Ctim != src.Ctim {
+		t.Errorf("unexpected times %+v, expected %+v", st, src)
+	}
+
+	// Attributes provided by Sys().
+	fsys := fstest.MapFS{
+		"attr.txt": &fstest.MapFile{Data: []byte("hello"), ModTime: mtime, Sys: &Attr{UID: 1234, GID: 5678, Nlink: 3, Blocks: 100, ATime: atime}},
+		"none.txt": &fstest.MapFile{Data: []byte("hello"), ModTime: mtime},
+	}
+	mount, err = MountFS(mountPoint, fsys, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := syscall.Stat(filepath.Join(mountPoint, "attr.txt"), &st); err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if st.Uid != 1234 || st.Gid != 5678 || st.Nlink != 3 || st.Blocks != 100 {
+		t.Errorf("unexpected attributes %+v", st)
+	}
+	if !time.Unix(st.Atim.Unix()).Equal(atime) || !time.Unix(st.Mtim.Unix()).Equal(mtime) || !time.Unix(st.Ctim.Unix()).Equal(mtime) {
+		t.Errorf("unexpected times %+v", st)
+	}
+
+	if err := syscall.Stat(filepath.Join(mountPoint, "none.txt"), &st); err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if st.Uid != 0 || st.Nlink != 1 || !time.Unix(st.Atim.Unix()).Equal(mtime) {
+		t.Errorf("unexpected attributes %+v", st)
+	}
+}
+
+func TestUnlinkedFile(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	mount, err := MountFS(mountPoint, &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	f, err := os.Create(filepath.Join(mountPoint, "file.txt"))
+	if err != nil {
+		t.Fatal("Create() error", err)
+	}
+	defer f.Close()
+	err = os.Remove(filepath.Join(mountPoint, "file.txt"))
+	if err != nil {
+		t.Fatal("Remove() error", err)
+	}
+
+	// Operations on the unlinked file must not affect the root.
+	if err := f.Chmod(0600); !errors.Is(err, syscall.ESTALE) {
+		t.Error("Chmod() should fail with ESTALE", err)
+	}
+	fi, err := os.Stat(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Error("unexpected mode of the root", fi.Mode())
+	}
+}
+
+func TestInodeDevice(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	fsys := fstest.MapFS{
+		"link1.txt": &fstest.MapFile{Data: []byte("link"), Sys: &Attr{Ino: 5, Nlink: 2}},
+		"link2.txt": &fstest.MapFile{Data: []byte("link"), Sys: &Attr{Ino: 5, Nlink: 2}},
+		"t1/f":      &fstest.MapFile{Data: []byte("t1"), Sys: &Attr{Dev: 1, Ino: 2}},
+		"t2/f":      &fstest.MapFile{Data: []byte("t2"), Sys: &Attr{Dev: 2, Ino: 2}},
+	}
+	mount, err := MountFS(mountPoint, fsys, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	stat := func(name string) fs.FileInfo {
+		fi, err := os.Stat(filepath.Join(mountPoint, name))
+		if err != nil {
+			t.Fatal("Stat() error", err)
+		}
+		return fi
+	}
+	if !os.SameFile(stat("link1.txt"), stat("link2.txt")) {
+		t.Error("hard links should be the same file")
+	}
+	if os.SameFile(stat("t1/f"), stat("t2/f")) {
+		t.Error("files on different devices should not be the same file")
+	}
+	for _, name := range []string{"t1/f", "t2/f"} {
+		data, err := os.ReadFile(filepath.Join(mountPoint, name))
+		if err != nil || string(data) != path.Dir(name) {
+			t.Error("unexpected content", name, string(data), err)
+		}
+	}
+}
+
+func TestStableInode(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	fsys := fstest.MapFS{
+		"a.txt": &fstest.MapFile{Data: []byte("a")},
+		"d/b":   &fstest.MapFile{Data: []byte("b")},
+		"t2/f":  &fstest.MapFile{Data: []byte("f"), Sys: &Attr{Dev: 2, Ino: 2}},
+	}
+	timeout := 10 * time.Millisecond
+	mount, err := MountFS(mountPoint, fsys, &MountOptions{EntryTimeout: &timeout})
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, name := range []string{"a.txt", "d", "t2/f"} {
+		fi1, err := os.Stat(filepath.Join(mountPoint, name))
+		if err != nil {
+			t.Fatal("Stat() error", err)
+		}
+		time.Sleep(timeout * 5)
+		fi2, err := os.Stat(filepath.Join(mountPoint, name))
+		if err != nil {
+			t.Fatal("Stat() error", err)
+		}
+		if !os.SameFile(fi1, fi2) {
+			t.Error("inode should be stable after the entry timeout", name,
+				fi1.Sys().(*syscall.Stat_t).Ino, fi2.Sys().(*syscall.Stat_t).Ino)
+		}
+	}
+}
+
+type testMkdirFs struct {
+	fstest.MapFS
+}
+
+func (fsys testMkdirFs) Mkdir(name string, mode fs.FileMode) error {
+	if name == "file" {
+		// Not a directory.
+		fsys.MapFS[name] = &fstest.MapFile{}
+	}
+	// Other directories are created lazily.
+	return nil
+}
+
+func TestMkdir(t *testing.T) {
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	mount, err := MountFS(mountPoint, testMkdirFs{fstest.MapFS{}}, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	err = os.Mkdir(filepath.Join(mountPoint, "lazy"), 0755)
+	if err != nil {
+		t.Error("Mkdir() error", err)
+	}
+	err = os.Mkdir(filepath.Join(mountPoint, "file"), 0755)
+	if !errors.Is(err, syscall.EIO) {
+		t.Error("Mkdir() should fail with EIO", err)
+	}
+}
+
+type testChtimesFs struct {
+	*testWritableFs
+	timesMu      sync.Mutex
+	atime, mtime time.Time
+}
+
+func (fsys *testChtimesFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	fsys.timesMu.Lock()
+	fsys.atime, fsys.mtime = atime, mtime
+	fsys.timesMu.Unlock()
+	return fsys.testWritableFs.Chtimes(name, atime, mtime)
+}
+
+func (fsys *testChtimesFs) times() (time.Time, time.Time) {
+	fsys.timesMu.Lock()
+	defer fsys.timesMu.Unlock()
+	return fsys.atime, fsys.mtime
+}
+
+func TestChtimesOmit(t *testing.T) {
+	targetDir, err := os.MkdirTemp("", "testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(targetDir)
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+
+	atime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mtime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.WriteFile(filepath.Join(targetDir, "file.txt"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(filepath.Join(targetDir, "file.txt"), atime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := &testChtimesFs{testWritableFs: &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}}
+	mount, err := MountFS(mountPoint, fsys, nil)
+	if err != nil {
+		t.Fatal("MountFS() error", err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// Zero times are passed as UTIME_OMIT.
+	newTime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(filepath.Join(mountPoint, "file.txt"), newTime, time.Time{})
+	if err != nil {
+		t.Fatal("Chtimes() error", err)
+	}
+	if a, m := fsys.times(); !a.Equal(newTime) || !m.Equal(mtime) {
+		t.Error("unexpected times", a, m)
+	}
+
+	err = os.Chtimes(filepath.Join(mountPoint, "file.txt"), time.Time{}, newTime)
+	if err != nil {
+		t.Fatal("Chtimes() error", err)
+	}
+	if a, m := fsys.times(); !a.Equal(newTime) || !m.Equal(newTime) {
+		t.Error("unexpected times", a, m)
+	}
+}
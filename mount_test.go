@@ -7,6 +7,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -85,7 +87,9 @@ func TestMountFS(t *testing.T) {
 
 type testWritableFs struct {
 	fs.FS
-	path string
+	path   string
+	mu     sync.Mutex
+	xattrs map[string]map[string][]byte
 }
 
 func (fsys *testWritableFs) OpenWriter(name string, flag int) (io.WriteCloser, error) {
@@ -104,6 +108,76 @@ func (fsys *testWritableFs) Rename(name, newName string) error {
 	return os.Rename(path.Join(fsys.path, name), path.Join(fsys.path, newName))
 }
 
+func (fsys *testWritableFs) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(path.Join(fsys.path, name), mode)
+}
+
+func (fsys *testWritableFs) Chown(name string, uid, gid int) error {
+	return os.Chown(path.Join(fsys.path, name), uid, gid)
+}
+
+func (fsys *testWritableFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(path.Join(fsys.path, name), atime, mtime)
+}
+
+func (fsys *testWritableFs) Link(oldname, newname string) error {
+	return os.Link(path.Join(fsys.path, oldname), path.Join(fsys.path, newname))
+}
+
+func (fsys *testWritableFs) Readlink(name string) (string, error) {
+	return os.Readlink(path.Join(fsys.path, name))
+}
+
+func (fsys *testWritableFs) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(path.Join(fsys.path, name))
+}
+
+func (fsys *testWritableFs) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, path.Join(fsys.path, newname))
+}
+
+func (fsys *testWritableFs) GetXattr(name string, attr string) ([]byte, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if data, ok := fsys.xattrs[name][attr]; ok {
+		return data, nil
+	}
+	return nil, ErrNoAttr
+}
+
+func (fsys *testWritableFs) SetXattr(name string, attr string, data []byte, flags int) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.xattrs == nil {
+		fsys.xattrs = map[string]map[string][]byte{}
+	}
+	if fsys.xattrs[name] == nil {
+		fsys.xattrs[name] = map[string][]byte{}
+	}
+	fsys.xattrs[name][attr] = append([]byte{}, data...)
+	return nil
+}
+
+func (fsys *testWritableFs) ListXattr(name string) ([]string, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	var attrs []string
+	for attr := range fsys.xattrs[name] {
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+func (fsys *testWritableFs) RemoveXattr(name string, attr string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if _, ok := fsys.xattrs[name][attr]; !ok {
+		return ErrNoAttr
+	}
+	delete(fsys.xattrs[name], attr)
+	return nil
+}
+
 func TestWritableFS(t *testing.T) {
 
 	targetDir := "testdata"
@@ -178,6 +252,21 @@ func TestWritableFS(t *testing.T) {
 		t.Fatal("Mkdir() error", err)
 	}
 
+	err = os.Mkdir(dname, fs.ModePerm)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Error("Mkdir() should fail with ErrExist", err)
+	}
+
+	files, err = os.ReadDir(mountPoint)
+	if err != nil {
+		t.Fatal("ReadDir() error", err)
+	}
+	for _, f := range files {
+		if f.Name() == "dir" && !f.IsDir() {
+			t.Error("ReadDir() should returns directory", f.Type())
+		}
+	}
+
 	err = os.Remove(dname)
 	if err != nil {
 		t.Fatal("Remove() dir error", err)
@@ -243,3 +332,179 @@ func TestWritableFS(t *testing.T) {
 		t.Error("Remove() error", err)
 	}
 }
+
+func TestSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlink is not supported")
+	}
+	targetDir := "testdata"
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	lname := filepath.Join(mountPoint, "link.txt")
+	_ = os.Remove(filepath.Join(targetDir, "link.txt"))
+
+	err = os.Symlink("hello.txt", lname)
+	if err != nil {
+		t.Fatal("Symlink() error", err)
+	}
+	defer os.Remove(lname)
+
+	target, err := os.Readlink(lname)
+	if err != nil {
+		t.Fatal("Readlink() error", err)
+	}
+	if target != "hello.txt" {
+		t.Error("Readlink() should returns hello.txt", target)
+	}
+
+	stat, err := os.Lstat(lname)
+	if err != nil {
+		t.Fatal("Lstat() error", err)
+	}
+	if stat.Mode()&fs.ModeSymlink == 0 {
+		t.Error("Lstat() should returns symlink", stat.Mode())
+	}
+
+	files, err := os.ReadDir(mountPoint)
+	if err != nil {
+		t.Fatal("ReadDir() error", err)
+	}
+	for _, f := range files {
+		if f.Name() == "link.txt" && f.Type()&fs.ModeSymlink == 0 {
+			t.Error("ReadDir() should returns symlink", f.Type())
+		}
+	}
+
+	b, err := os.ReadFile(lname)
+	if err != nil {
+		t.Error("ReadFile() error", err)
+	}
+	t.Log("Content: ", string(b))
+}
+
+func TestLink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard link is not supported")
+	}
+	targetDir := "testdata"
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "hello.txt")
+	lname := filepath.Join(mountPoint, "hello.txt.link")
+	_ = os.Remove(filepath.Join(targetDir, "hello.txt.link"))
+
+	err = os.Link(fname, lname)
+	if err != nil {
+		t.Fatal("Link() error", err)
+	}
+	defer os.Remove(lname)
+
+	stat1, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	stat2, err := os.Stat(lname)
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if !os.SameFile(stat1, stat2) {
+		t.Error("SameFile() should returns true")
+	}
+}
+
+func TestSetAttr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("chmod is not supported")
+	}
+	targetDir := "testdata"
+	mountPoint, err := os.MkdirTemp("", "testmount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mountPoint)
+	t.Log("Mount point:", mountPoint)
+
+	mount, err := MountFS(mountPoint, &testWritableFs{FS: os.DirFS(targetDir), path: targetDir}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	fname := filepath.Join(mountPoint, "setattr.txt")
+	err = os.WriteFile(fname, []byte("chmod"), 0644)
+	if err != nil {
+		t.Fatal("WriteFile() error", err)
+	}
+	defer os.Remove(fname)
+
+	err = os.Chmod(fname, 0600)
+	if err != nil {
+		t.Fatal("Chmod() error", err)
+	}
+
+	stat, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Error("Mode() should returns 0600", stat.Mode())
+	}
+
+	err = os.Chown(fname, os.Getuid(), os.Getgid())
+	if err != nil {
+		t.Error("Chown() error", err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = os.Chtimes(fname, mtime, mtime)
+	if err != nil {
+		t.Fatal("Chtimes() error", err)
+	}
+
+	stat, err = os.Stat(fname)
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if !stat.ModTime().Equal(mtime) {
+		t.Error("ModTime() should returns", mtime, stat.ModTime())
+	}
+
+	// Keep mtime
+	err = os.Chtimes(fname, time.Now(), time.Time{})
+	if err != nil {
+		t.Fatal("Chtimes() error", err)
+	}
+
+	stat, err = os.Stat(fname)
+	if err != nil {
+		t.Fatal("Stat() error", err)
+	}
+	if !stat.ModTime().Equal(mtime) {
+		t.Error("ModTime() should returns", mtime, stat.ModTime())
+	}
+}
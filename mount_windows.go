@@ -1,11 +1,15 @@
 package fsmount
 
 import (
+	"context"
 	"io/fs"
+	"path"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/binzume/dkango"
+	"github.com/binzume/dkango/dokan"
 )
 
 func fileATime(fi fs.FileInfo) time.Time {
@@ -22,26 +26,94 @@ func fileCTime(fi fs.FileInfo) time.Time {
 	return fi.ModTime()
 }
 
-func MountFS(mountPoint string, fsys fs.FS, opt *MountOptions) (MountHandle, error) {
-	if opt == nil {
-		opt = &MountOptions{}
+func callerFromContext(ctx context.Context) (Caller, bool) {
+	return Caller{}, false
+}
+
+type handle struct {
+	*mountState
+	mi   *dokan.MountInfo
+	fsys fs.FS
+}
+
+func (h *handle) Stats() MountStats {
+	return MountStats{OpenFiles: h.mi.OpenedFileCount()}
+}
+
+func (h *handle) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(h.mountPoint+`\`, filepath.FromSlash(name)), nil
+}
+
+func (h *handle) InvalidatePath(name string) error {
+	p, err := h.path("invalidate", name)
+	if err != nil {
+		return err
+	}
+	return h.mi.NotifyUpdate(p)
+}
+
+func (h *handle) InvalidateData(name string, off, length int64) error {
+	// Dokan can't invalidate a part of the file.
+	return h.InvalidatePath(name)
+}
+
+func (h *handle) InvalidateEntry(dir, name string) error {
+	name = path.Join(dir, name)
+	p, err := h.path("invalidate", name)
+	if err != nil {
+		return err
 	}
+	fi, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return h.mi.NotifyDelete(p, false)
+	}
+	return h.mi.NotifyCreate(p, fi.IsDir())
+}
+
+func mount(mountPoint string, fsys fs.FS, opt *MountOptions) (*handle, error) {
 	mountOpt, _ := opt.FuseOption.(*dkango.MountOptions)
-	if opt.ReadOnly {
-		if mountOpt == nil {
-			mountOpt = &dkango.MountOptions{
-				Flags: dkango.FlagAltStream,
-			}
+	if mountOpt == nil {
+		// Same as the default of dkango.
+		mountOpt = &dkango.MountOptions{
+			VolumeInfo: dokan.VolumeInformation{FileSystemName: "Dokan"},
+			Flags:      dkango.FlagAltStream,
 		}
+	}
+	if opt.ReadOnly {
 		mountOpt.Flags |= dkango.FlagsWriteProtect
 	}
 	if opt.Debug {
-		if mountOpt == nil {
-			mountOpt = &dkango.MountOptions{
-				Flags: dkango.FlagAltStream,
+		mountOpt.Flags |= dkango.FlagDebug | dkango.FlagStderr
+	}
+	if opt.VolumeLabel != "" {
+		mountOpt.VolumeInfo.Name = opt.VolumeLabel
+	}
+	if opt.Subtype != "" {
+		mountOpt.VolumeInfo.FileSystemName = opt.Subtype
+	}
+	if fsys, ok := fsys.(DiskUsageFS); ok {
+		mountOpt.DiskSpaceFunc = func() dkango.DiskSpace {
+			usage, _ := fsys.DiskUsage()
+			return dkango.DiskSpace{
+				FreeBytesAvailable:     usage.Available,
+				TotalNumberOfBytes:     usage.Total,
+				TotalNumberOfFreeBytes: usage.Free,
 			}
 		}
-		mountOpt.Flags |= dkango.FlagDebug | dkango.FlagStderr
 	}
-	return dkango.MountFS(mountPoint, fsys, mountOpt)
+	mi, err := dkango.MountFS(mountPoint, fsys, mountOpt)
+	if err != nil {
+		return nil, err
+	}
+	// Dokan doesn't tell when the file system is unmounted externally.
+	h := &handle{mountState: newMountState(mountPoint, mi.Close), mi: mi, fsys: fsys}
+	err = h.watch(fsys, h)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
 }
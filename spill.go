@@ -0,0 +1,148 @@
+package fsmount
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+const (
+	// Data read from a stream is kept in memory up to this size, then moved to a temporary file.
+	spillMemLimit  = 8 * 1024 * 1024
+	spillChunkSize = 64 * 1024
+)
+
+// spillReader provides io.ReaderAt for a file that can only be read sequentially.
+// Data read from the stream is kept, so reads can be served in any order.
+// Recent data is kept in memory, and older data is moved to a temporary file.
+type spillReader struct {
+	file     io.ReadCloser
+	memLimit int
+
+	mu   sync.Mutex
+	tmp  *os.File // Data before base.
+	base int64    // Offset of mem[0].
+	mem  []byte
+	size int64 // Bytes read from file.
+	err  error // Error returned by file.Read() or failure of storing data. Usually io.EOF.
+	buf  []byte
+}
+
+func newSpillReader(f io.ReadCloser, memLimit int) *spillReader {
+	return &spillReader{file: f, memLimit: memLimit}
+}
+
+// fill reads the stream until size reaches end or the stream ends.
+func (s *spillReader) fill(end int64) {
+	if s.buf == nil && s.size < end {
+		s.buf = make([]byte, spillChunkSize)
+	}
+	for s.size < end && s.err == nil {
+		n, err := s.file.Read(s.buf)
+		if n > 0 {
+			if serr := s.store(s.buf[:n]); serr != nil {
+				// Data is lost. Following reads would get data at wrong offsets.
+				err = serr
+			}
+		}
+		if err != nil {
+			s.err = err
+		}
+	}
+}
+
+func (s *spillReader) store(b []byte) error {
+	s.mem = append(s.mem, b...)
+	s.size += int64(len(b))
+	if len(s.mem) <= s.memLimit {
+		return nil
+	}
+	if s.tmp == nil {
+		tmp, err := os.CreateTemp("", "fsmount-spill-*")
+		if err != nil {
+			return err
+		}
+		s.tmp = tmp
+	}
+	// Keep the latter half in memory for reads slightly out of order.
+	n := len(s.mem) - s.memLimit/2
+	if _, err := s.tmp.WriteAt(s.mem[:n], s.base); err != nil {
+		return err
+	}
+	s.mem = append(s.mem[:0], s.mem[n:]...)
+	s.base += int64(n)
+	return nil
+}
+
+func (s *spillReader) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil && s.err != io.EOF {
+		return 0, s.err
+	}
+	if off == s.size && s.err == nil {
+		// Sequential read. Read the stream directly.
+		n, err := io.ReadFull(s.file, b)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if serr := s.store(b[:n]); serr != nil {
+			err = serr
+		}
+		s.err = err
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		return n, err
+	}
+	s.fill(off + int64(len(b)))
+	if s.err != nil && s.err != io.EOF {
+		return 0, s.err
+	}
+	if off >= s.size {
+		return 0, s.err
+	}
+
+	n := len(b)
+	if off+int64(n) > s.size {
+		n = int(s.size - off)
+	}
+	p := b[:n]
+	if off < s.base {
+		l := n
+		if off+int64(l) > s.base {
+			l = int(s.base - off)
+		}
+		if _, err := s.tmp.ReadAt(p[:l], off); err != nil {
+			return 0, err
+		}
+		p, off = p[l:], off+int64(l)
+	}
+	if len(p) > 0 {
+		copy(p, s.mem[off-s.base:])
+	}
+	if n < len(b) {
+		return n, s.err
+	}
+	return n, nil
+}
+
+func (s *spillReader) Stat() (fs.FileInfo, error) {
+	if st, ok := s.file.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		return st.Stat()
+	}
+	return nil, fs.ErrInvalid
+}
+
+func (s *spillReader) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tmp != nil {
+		s.tmp.Close()
+		os.Remove(s.tmp.Name())
+		s.tmp = nil
+	}
+	s.mem = nil
+	return s.file.Close()
+}
@@ -0,0 +1,95 @@
+package fsmount
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSpillReader(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+
+	for _, memLimit := range []int{1 << 20, 1000} {
+		r := newSpillReader(io.NopCloser(bytes.NewReader(data)), memLimit)
+
+		buf := make([]byte, 4096)
+		for _, off := range []int64{50000, 0, 1234, 99000, 40000} {
+			n, err := r.ReadAt(buf, off)
+			end := off + int64(len(buf))
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			if err != nil && err != io.EOF {
+				t.Fatal("ReadAt() error", err)
+			}
+			if !bytes.Equal(buf[:n], data[off:end]) {
+				t.Errorf("ReadAt() unexpected data. memLimit:%v off:%v", memLimit, off)
+			}
+		}
+		if memLimit == 1000 && r.tmp == nil {
+			t.Error("data should be spilled to a temporary file")
+		}
+
+		n, err := r.ReadAt(buf, int64(len(data)))
+		if n != 0 || err != io.EOF {
+			t.Error("ReadAt() should return EOF", n, err)
+		}
+
+		err = r.Close()
+		if err != nil {
+			t.Error("Close() error", err)
+		}
+	}
+}
+
+func TestSpillReaderSequential(t *testing.T) {
+	data := make([]byte, 3*1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	memLimit := 1024 * 1024
+	r := newSpillReader(io.NopCloser(bytes.NewReader(data)), memLimit)
+	defer r.Close()
+
+	buf := make([]byte, 128*1024)
+	for off := int64(0); off < int64(len(data)); off += int64(len(buf)) {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			t.Fatal("ReadAt() error", err)
+		}
+		if !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+			t.Fatal("ReadAt() unexpected data. off:", off)
+		}
+	}
+	if len(r.mem) > memLimit {
+		t.Error("data in memory should be limited", len(r.mem))
+	}
+
+	// Seek backward.
+	for _, off := range []int64{int64(len(data) - len(buf)*2), 0, int64(len(data) - memLimit/2 - 10)} {
+		n, err := r.ReadAt(buf, off)
+		if err != nil || !bytes.Equal(buf[:n], data[off:off+int64(n)]) {
+			t.Error("ReadAt() failed. off:", off, err)
+		}
+	}
+}
+
+func TestSpillReaderStoreError(t *testing.T) {
+	t.Setenv("TMPDIR", "/nonexistent")
+	data := make([]byte, 100000)
+	r := newSpillReader(io.NopCloser(bytes.NewReader(data)), 1000)
+	defer r.Close()
+
+	buf := make([]byte, 4096)
+	if _, err := r.ReadAt(buf, 50000); err == nil {
+		t.Fatal("ReadAt() should fail")
+	}
+	for _, off := range []int64{0, 50000, 60000} {
+		if _, err := r.ReadAt(buf, off); err == nil {
+			t.Error("ReadAt() should keep failing. off:", off)
+		}
+	}
+}
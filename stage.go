@@ -0,0 +1,186 @@
+package fsmount
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// stagedFile buffers writes in a temporary file and uploads the whole content to the writer on Flush and Close.
+// It allows random writes to a writer which only supports sequential writes.
+type stagedFile struct {
+	fsys   fs.FS
+	name   string
+	reopen func() (io.WriteCloser, error) // Opens a writer to upload again after Flush.
+
+	mu     sync.Mutex
+	w      io.WriteCloser // Not uploaded yet if not nil.
+	tmp    *os.File
+	loaded bool // tmp has the current content.
+	dirty  bool // Modified after the last upload.
+	closed bool
+}
+
+func newStagedFile(fsys fs.FS, name string, w io.WriteCloser, trunc bool, reopen func() (io.WriteCloser, error)) (*stagedFile, error) {
+	tmp, err := os.CreateTemp("", "fsmount-stage-*")
+	if err != nil {
+		return nil, err
+	}
+	return &stagedFile{fsys: fsys, name: name, reopen: reopen, w: w, tmp: tmp, loaded: trunc}, nil
+}
+
+// load copies the current content of the file to tmp. s.mu must be held.
+func (s *stagedFile) load() error {
+	if s.closed {
+		return fs.ErrClosed
+	}
+	if s.loaded {
+		return nil
+	}
+	f, err := s.fsys.Open(s.name)
+	if err == nil {
+		defer f.Close()
+		_, err = io.Copy(s.tmp, f)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *stagedFile) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	err := s.load()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return s.tmp.ReadAt(b, off)
+}
+
+func (s *stagedFile) WriteAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	err := s.load()
+	s.dirty = true
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return s.tmp.WriteAt(b, off)
+}
+
+func (s *stagedFile) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size == 0 && !s.closed {
+		// No need to load the current content.
+		s.loaded = true
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.dirty = true
+	return s.tmp.Truncate(size)
+}
+
+// Stat returns the file info of the backend file with the staged size.
+func (s *stagedFile) Stat() (fs.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, fs.ErrClosed
+	}
+	fi, err := fs.Stat(s.fsys, s.name)
+	if !s.loaded {
+		return fi, err
+	}
+	tfi, terr := s.tmp.Stat()
+	if terr != nil {
+		return nil, terr
+	}
+	if err != nil {
+		// Not uploaded yet.
+		return tfi, nil
+	}
+	return &stagedFileInfo{FileInfo: fi, size: tfi.Size(), modTime: tfi.ModTime()}, nil
+}
+
+// upload writes the staged content to the writer and closes it. s.mu must be held.
+func (s *stagedFile) upload() error {
+	if err := s.load(); err != nil {
+		return err
+	}
+	w := s.w
+	s.w = nil
+	if w == nil {
+		var err error
+		if w, err = s.reopen(); err != nil {
+			return err
+		}
+	}
+	_, err := s.tmp.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(w, s.tmp)
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	// Retry on the next Flush or Close if failed.
+	s.dirty = err != nil
+	return err
+}
+
+// Flush uploads the staged content if modified, so the error is reported to close(2).
+func (s *stagedFile) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fs.ErrClosed
+	}
+	if s.w == nil && !s.dirty {
+		return nil
+	}
+	return s.upload()
+}
+
+// Close uploads the staged content if not uploaded yet.
+func (s *stagedFile) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fs.ErrClosed
+	}
+	defer os.Remove(s.tmp.Name())
+	defer s.tmp.Close()
+
+	var err error
+	if s.w != nil || s.dirty {
+		err = s.upload()
+	}
+	if s.w != nil {
+		// Failed to load the content.
+		s.w.Close()
+	}
+	s.closed = true
+	return err
+}
+
+type stagedFileInfo struct {
+	fs.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (fi *stagedFileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *stagedFileInfo) ModTime() time.Time {
+	return fi.modTime
+}